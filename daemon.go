@@ -0,0 +1,199 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/elrichgro/protofuse/mount"
+	"github.com/elrichgro/protofuse/registry"
+)
+
+// Set in the environment of a background mount process started by -daemon.
+const daemonEnv = "PROTOFUSE_DAEMON"
+
+// The file descriptor a background mount process reports readiness on.
+const readyFD = 3
+
+// Reports whether this process is a background mount process.
+func isDaemon() bool {
+	return os.Getenv(daemonEnv) != ""
+}
+
+// Starts this command again as a background mount process and waits for it
+// to report that the mount is up. Its output goes to daemon.log in the
+// registry directory.
+func startDaemon(mountpoint string) error {
+	dir, err := registry.Dir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	logName := filepath.Join(dir, "daemon.log")
+	logFile, err := os.OpenFile(logName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.ExtraFiles = []*os.File{w}
+	// detach from the terminal, so the mount outlives it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+
+	line, _ := bufio.NewReader(r).ReadString('\n')
+	if strings.TrimSpace(line) != "ready" {
+		cmd.Wait()
+		return fmt.Errorf("Mounting %s failed, see %s", mountpoint, logName)
+	}
+	fmt.Printf("%s mounted by process %d\n", mountpoint, cmd.Process.Pid)
+	return cmd.Process.Release()
+}
+
+// Records the mount of a background mount process in the registry and
+// tells the process that started it that the mount is up. The returned
+// function removes the record.
+func registerDaemon(e registry.Entry) (func(), error) {
+	e.PID = os.Getpid()
+	if err := registry.Add(e); err != nil {
+		return nil, err
+	}
+	ready := os.NewFile(readyFD, "ready")
+	fmt.Fprintln(ready, "ready")
+	ready.Close()
+	return func() {
+		if err := registry.Remove(e.PID); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}, nil
+}
+
+// Lists the mounts served by background processes.
+func listCommand(args []string) {
+	fs := flag.NewFlagSet(os.Args[0]+" list", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s list\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	entries, err := registry.List()
+	CheckError(err)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PID\tSTATE\tMOUNTPOINT\tSOURCE\tMESSAGE\tSTARTED")
+	for _, e := range entries {
+		state := "active"
+		if !e.Alive() {
+			state = "stale"
+		}
+		// a mount of several sources gives their types in Source
+		message := "-"
+		if e.MessageName != "" {
+			message = e.PackageName + "." + e.MessageName
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", e.PID, state, e.MountPoint, e.Source, message, e.Started.Format("2006-01-02 15:04:05"))
+	}
+	w.Flush()
+}
+
+// Unmounts mounts served by background processes, or any mount point given.
+func unmountCommand(args []string) {
+	fs := flag.NewFlagSet(os.Args[0]+" unmount", flag.ExitOnError)
+	all := fs.Bool("all", false, "unmount every mount in the registry, cleaning up stale entries")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s unmount [-all] [MOUNT_LOCATION...]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 && !*all {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	entries, err := registry.List()
+	CheckError(err)
+
+	var targets []registry.Entry
+	if *all {
+		targets = entries
+	}
+	for _, arg := range fs.Args() {
+		mountpoint, err := filepath.Abs(arg)
+		CheckError(err)
+		target := registry.Entry{MountPoint: mountpoint}
+		for _, e := range entries {
+			if e.MountPoint == mountpoint {
+				target = e
+			}
+		}
+		targets = append(targets, target)
+	}
+
+	failed := false
+	for _, e := range targets {
+		if err := unmountEntry(e); err != nil {
+			fmt.Printf("%s: %v\n", e.MountPoint, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(-1)
+	}
+}
+
+// Unmounts the mount of e. A live process removes its own entry once its
+// mount is gone; the entry of a process that has died is removed here.
+func unmountEntry(e registry.Entry) error {
+	if e.PID != 0 && !e.Alive() {
+		if _, err := mount.CleanStale(e.MountPoint); err != nil {
+			return err
+		}
+		return registry.Remove(e.PID)
+	}
+	if stale, err := mount.CleanStale(e.MountPoint); stale || err != nil {
+		return err
+	}
+	return mount.Unmount(e.MountPoint)
+}
@@ -0,0 +1,123 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/elrichgro/protofuse/fuse"
+	"github.com/elrichgro/protofuse/unmarshal"
+)
+
+// Prints the decoded protocol buffer to stdout, for environments where
+// FUSE is not available.
+func dumpCommand(args []string) {
+	fs := flag.NewFlagSet(os.Args[0]+" dump", flag.ExitOnError)
+	format := fs.String("format", "tree", "output format: tree, json or text")
+	in := addInputFlags(fs)
+	render := addRenderFlags(fs)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s dump [flags] MARSHALLED_PROTOCOL_BUFFER, PROTO_FILE_LOCATION, PACKAGE_NAME, MESSAGE_NAME\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 4 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	opts, err := render.options()
+	CheckError(err)
+
+	fileDescSet, err := loadSchema(fs.Arg(1))
+	CheckError(err)
+
+	entries, err := readMessages(fs.Arg(0), in, fileDescSet, fs.Arg(2), fs.Arg(3))
+	CheckError(err)
+
+	PT, err := unmarshal.UnmarshalEntries(fileDescSet, fs.Arg(2), fs.Arg(3), entries, opts)
+	CheckError(err)
+
+	err = dump(os.Stdout, PT, *format)
+	CheckError(err)
+}
+
+// Writes the messages in PT to w in format. The tree format shows the files
+// at the root, such as the errors of records, with the messages; the other
+// formats leave them out and warn about them on stderr.
+func dump(w io.Writer, PT *pfuse.ProtoTree, format string) error {
+	if format == "tree" {
+		return PT.Dir.WriteTree(w)
+	}
+
+	var names []string
+	var dirs []*pfuse.Dir
+	for _, tn := range PT.Dir.Nodes {
+		switch node := tn.Node.(type) {
+		case *pfuse.Dir:
+			names = append(names, tn.Name)
+			dirs = append(dirs, node)
+		case *pfuse.File:
+			fmt.Fprintf(os.Stderr, "%s: %s", tn.Name, node.Contents)
+		}
+	}
+
+	switch format {
+	case "json":
+		// a single message is written as is, a list as an array
+		if len(dirs) == 1 {
+			p, err := dirs[0].JSON()
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(p)
+			return err
+		}
+		messages := []json.RawMessage{}
+		for _, dir := range dirs {
+			p, err := dir.JSON()
+			if err != nil {
+				return err
+			}
+			messages = append(messages, p)
+		}
+		p, err := json.MarshalIndent(messages, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", p)
+		return err
+	case "text":
+		var b bytes.Buffer
+		for i, dir := range dirs {
+			if len(dirs) > 1 {
+				if i > 0 {
+					b.WriteByte('\n')
+				}
+				fmt.Fprintf(&b, "# %s\n", names[i])
+			}
+			b.Write(dir.Text())
+		}
+		_, err := w.Write(b.Bytes())
+		return err
+	}
+	return fmt.Errorf("Unknown output format: %s", format)
+}
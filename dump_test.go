@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/elrichgro/protofuse/test"
+	"github.com/elrichgro/protofuse/unmarshal"
+	"github.com/gogo/protobuf/proto"
+)
+
+// The expected output of dump in each format for the message of TestDump.
+var dumpGolden = map[string]string{
+	"tree": `.
+└── Message_1
+    ├── f1: one
+    ├── f2_1: 1
+    ├── f2_2: 2
+    ├── f11: 0b0b
+    ├── f12
+    │   └── id: 123
+    └── f16_1
+        ├── f1: name
+        ├── f2: e1
+        └── f3
+            └── name: name
+`,
+	"json": `{
+  "f1": "one",
+  "f2": [
+    1,
+    2
+  ],
+  "f11": "Cws=",
+  "f12": {
+    "id": 123
+  },
+  "f16": [
+    {
+      "f1": "name",
+      "f2": "e1",
+      "f3": {
+        "name": "name"
+      }
+    }
+  ]
+}
+`,
+	"text": `f1: "one"
+f2: 1
+f2: 2
+f11: "\013\013"
+f12 {
+  id: 123
+}
+f16 {
+  f1: "name"
+  f2: e1
+  f3 {
+    name: "name"
+  }
+}
+`,
+}
+
+func TestDump(t *testing.T) {
+	_, fDesc, packageName, messageName, err := test.GenerateFull()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a message with nested, repeated and bytes fields
+	f1, id, name := "one", int32(123), "name"
+	buf, err := proto.Marshal(&test.Foo{F1: &f1, F2: []int32{1, 2}, F11: []byte{11, 11}, F12: &test.Bar{Id: &id},
+		F16: []*test.FooBaz{{F1: &name, F2: test.Foo_e1.Enum(), F3: &test.FooBazFoobaz{Name: &name}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	PT, err := unmarshal.Unmarshal(fDesc, packageName, messageName, [][]byte{buf})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for format, expected := range dumpGolden {
+		var b bytes.Buffer
+		if err := dump(&b, PT, format); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != expected {
+			t.Error(fmt.Sprintf("%s output doesn't match:\n%s\nexpected:\n%s", format, b.String(), expected))
+		}
+	}
+	if err := dump(&bytes.Buffer{}, PT, "yaml"); err == nil {
+		t.Error("Expected an unknown format to be rejected")
+	}
+}
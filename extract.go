@@ -0,0 +1,100 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/elrichgro/protofuse/marshal"
+	"github.com/elrichgro/protofuse/unmarshal"
+)
+
+// Writes the decoded protocol buffer to a directory on disk, laid out as
+// the mount would show it.
+func extractCommand(args []string) {
+	fs := flag.NewFlagSet(os.Args[0]+" extract", flag.ExitOnError)
+	out := fs.String("out", "", "directory to write the tree to")
+	in := addInputFlags(fs)
+	render := addRenderFlags(fs)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s extract -out DIR [flags] MARSHALLED_PROTOCOL_BUFFER, PROTO_FILE_LOCATION, PACKAGE_NAME, MESSAGE_NAME\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 4 || *out == "" {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	opts, err := render.options()
+	CheckError(err)
+
+	fileDescSet, err := loadSchema(fs.Arg(1))
+	CheckError(err)
+
+	entries, err := readMessages(fs.Arg(0), in, fileDescSet, fs.Arg(2), fs.Arg(3))
+	CheckError(err)
+
+	PT, err := unmarshal.UnmarshalEntries(fileDescSet, fs.Arg(2), fs.Arg(3), entries, opts)
+	CheckError(err)
+
+	err = PT.Dir.Extract(*out)
+	CheckError(err)
+}
+
+// Encodes a directory tree written by extract, or copied out of a mount,
+// back into the wire format.
+func packCommand(args []string) {
+	fs := flag.NewFlagSet(os.Args[0]+" pack", flag.ExitOnError)
+	out := fs.String("out", "", "file to write the marshalled protocol buffer to, instead of stdout")
+	render := addRenderFlags(fs)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s pack [-out FILE] [flags] DIR, PROTO_FILE_LOCATION, PACKAGE_NAME, MESSAGE_NAME\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 4 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	opts, err := render.options()
+	CheckError(err)
+
+	fileDescSet, err := loadSchema(fs.Arg(1))
+	CheckError(err)
+
+	// accept the root written by extract as well as the message directory
+	dir := fs.Arg(0)
+	if matches, _ := filepath.Glob(filepath.Join(dir, "Message_*")); len(matches) == 1 {
+		dir = matches[0]
+	}
+
+	buf, err := marshal.Directory(fileDescSet, fs.Arg(2), fs.Arg(3), dir, opts)
+	CheckError(err)
+
+	if *out == "" {
+		_, err = os.Stdout.Write(buf)
+	} else {
+		err = ioutil.WriteFile(*out, buf, 0644)
+	}
+	CheckError(err)
+}
@@ -0,0 +1,223 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/elrichgro/protofuse/unmarshal"
+)
+
+// inputFlags are the flags controlling how the input is read.
+type inputFlags struct {
+	format  *string
+	typeMap *string
+}
+
+func addInputFlags(fs *flag.FlagSet) *inputFlags {
+	return &inputFlags{
+		format:  fs.String("input-format", "auto", "encoding of the input: auto, binary, text, json, hex, base64, base64-lines (one message per line), tfrecord or recordio (varint delimited records)"),
+		typeMap: fs.String("type-map", "", "JSON file mapping input file names or patterns to message types, for directory and glob inputs"),
+	}
+}
+
+// Reads the mapping of file names to message types given by -type-map.
+func (f *inputFlags) types() (map[string]string, error) {
+	types := map[string]string{}
+	if *f.typeMap == "" {
+		return types, nil
+	}
+	data, err := ioutil.ReadFile(*f.typeMap)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &types); err != nil {
+		return nil, fmt.Errorf("%s: %v", *f.typeMap, err)
+	}
+	return types, nil
+}
+
+// renderFlags are the flags controlling how decoded values are presented,
+// shared by every command that decodes protocol buffers.
+type renderFlags struct {
+	bytes           *string
+	bytesViews      *string
+	bytesField      fieldFormats
+	embed           embeddedTypes
+	embedConfig     *string
+	keepAny         *bool
+	structuralWKT   *bool
+	showSensitive   *bool
+	sensitiveOption *string
+	unitOption      *string
+	formatOption    *string
+	naming          *string
+	keys            fieldKeys
+}
+
+func addRenderFlags(fs *flag.FlagSet) *renderFlags {
+	f := &renderFlags{
+		bytes:           fs.String("bytes", "hex", "rendering of bytes fields: hex, base64, hexdump, raw or auto"),
+		bytesViews:      fs.String("bytes-views", "", "comma separated alternate views of bytes fields, e.g. hex,base64,raw"),
+		bytesField:      fieldFormats{},
+		embed:           embeddedTypes{},
+		embedConfig:     fs.String("embed-config", "", "JSON file mapping bytes fields to the message types they contain"),
+		keepAny:         fs.Bool("keep-any", false, "show google.protobuf.Any as its type_url and value fields instead of the packed message"),
+		structuralWKT:   fs.Bool("structural-wkt", false, "show well-known types such as Timestamp as directories of their fields instead of their JSON form"),
+		showSensitive:   fs.Bool("show-sensitive", false, "show the values of fields marked with the sensitive option instead of redacting them"),
+		sensitiveOption: fs.String("sensitive-option", "sensitive", "custom bool field option marking fields to redact"),
+		unitOption:      fs.String("unit-option", "unit", "custom string field option holding a unit to append to values"),
+		formatOption:    fs.String("format-option", "format", "custom string field option choosing the bytes or number format of values"),
+		naming:          fs.String("naming", "", "comma separated naming schemes: pad (for repeated fields and root entries), subdirs (repeated fields as directories of their elements), ext (type extensions on field files)"),
+		keys:            fieldKeys{},
+	}
+	fs.Var(f.bytesField, "bytes-field", "bytes rendering of a single field, as FIELD=FORMAT (repeatable)")
+	fs.Var(f.embed, "embed", "decode a bytes field as a message, as FIELD=MESSAGE_TYPE (repeatable)")
+	fs.Var(f.keys, "key", "name the elements of a repeated message field after one of their fields, as FIELD=KEY_FIELD (repeatable)")
+	return f
+}
+
+// Builds the unmarshal.Options selected on the command line.
+func (f *renderFlags) options() (unmarshal.Options, error) {
+	opts := unmarshal.Options{
+		KeepAny:                  *f.keepAny,
+		StructuralWellKnownTypes: *f.structuralWKT,
+		Annotations: unmarshal.Annotations{
+			Sensitive: *f.sensitiveOption,
+			Unit:      *f.unitOption,
+			Format:    *f.formatOption,
+		},
+		ShowSensitive: *f.showSensitive,
+	}
+	var err error
+
+	opts.Bytes, err = unmarshal.ParseBytesFormat(*f.bytes)
+	if err != nil {
+		return opts, err
+	}
+	opts.FieldBytes = f.bytesField
+	if *f.bytesViews != "" {
+		for _, name := range strings.Split(*f.bytesViews, ",") {
+			format, err := unmarshal.ParseBytesFormat(strings.TrimSpace(name))
+			if err != nil {
+				return opts, err
+			}
+			opts.BytesViews = append(opts.BytesViews, format)
+		}
+	}
+
+	opts.Embedded = embeddedTypes{}
+	if *f.embedConfig != "" {
+		data, err := ioutil.ReadFile(*f.embedConfig)
+		if err != nil {
+			return opts, err
+		}
+		var config map[string]string
+		if err := json.Unmarshal(data, &config); err != nil {
+			return opts, fmt.Errorf("%s: %v", *f.embedConfig, err)
+		}
+		for field, typeName := range config {
+			opts.Embedded[strings.TrimPrefix(field, ".")] = typeName
+		}
+	}
+	for field, typeName := range f.embed {
+		opts.Embedded[field] = typeName
+	}
+
+	if *f.naming != "" {
+		for _, scheme := range strings.Split(*f.naming, ",") {
+			switch strings.TrimSpace(scheme) {
+			case "pad":
+				opts.Naming.Pad = true
+			case "subdirs":
+				opts.Naming.Subdirs = true
+			case "ext":
+				opts.Naming.Extensions = true
+			default:
+				return opts, fmt.Errorf("Unknown naming scheme: %s", scheme)
+			}
+		}
+	}
+	opts.Naming.Keys = f.keys
+	return opts, nil
+}
+
+// fieldFormats collects repeated FIELD=FORMAT flags.
+type fieldFormats map[string]unmarshal.BytesFormat
+
+func (f fieldFormats) String() string {
+	var s []string
+	for field, format := range f {
+		s = append(s, field+"="+format.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (f fieldFormats) Set(value string) error {
+	i := strings.LastIndex(value, "=")
+	if i < 0 {
+		return fmt.Errorf("Expected FIELD=FORMAT, got %s", value)
+	}
+	format, err := unmarshal.ParseBytesFormat(value[i+1:])
+	if err != nil {
+		return err
+	}
+	f[strings.TrimPrefix(value[:i], ".")] = format
+	return nil
+}
+
+// embeddedTypes collects repeated FIELD=MESSAGE_TYPE flags.
+type embeddedTypes map[string]string
+
+func (e embeddedTypes) String() string {
+	var s []string
+	for field, typeName := range e {
+		s = append(s, field+"="+typeName)
+	}
+	return strings.Join(s, ",")
+}
+
+func (e embeddedTypes) Set(value string) error {
+	i := strings.LastIndex(value, "=")
+	if i < 0 {
+		return fmt.Errorf("Expected FIELD=MESSAGE_TYPE, got %s", value)
+	}
+	e[strings.TrimPrefix(value[:i], ".")] = value[i+1:]
+	return nil
+}
+
+// fieldKeys collects repeated FIELD=KEY_FIELD flags.
+type fieldKeys map[string]string
+
+func (k fieldKeys) String() string {
+	var s []string
+	for field, key := range k {
+		s = append(s, field+"="+key)
+	}
+	return strings.Join(s, ",")
+}
+
+func (k fieldKeys) Set(value string) error {
+	i := strings.LastIndex(value, "=")
+	if i < 0 {
+		return fmt.Errorf("Expected FIELD=KEY_FIELD, got %s", value)
+	}
+	k[strings.TrimPrefix(value[:i], ".")] = value[i+1:]
+	return nil
+}
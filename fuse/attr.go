@@ -0,0 +1,105 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package pfuse
+
+import (
+	"os"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// Stat holds the attributes shared by the nodes of a tree.
+type Stat struct {
+	// Mtime is the modification time of the source of the tree.
+	Mtime time.Time
+	Uid   uint32
+	Gid   uint32
+}
+
+// NewStat gets the attributes of a tree read from a source last modified
+// at mtime, owned by the user running the process.
+func NewStat(mtime time.Time) Stat {
+	return Stat{Mtime: mtime, Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+}
+
+// SetStat sets the attributes of every node of the tree, and numbers the
+// nodes after their path below root, so that a node keeps its inode number
+// across mounts and reloads as long as its path is unchanged.
+func (t *ProtoTree) SetStat(root string, stat Stat) {
+	t.Dir.setStat(childInode(fnvOffset, root), &stat)
+}
+
+func (dir *Dir) setStat(inode uint64, stat *Stat) {
+	dir.Inode = inode
+	dir.Stat = stat
+	for _, tn := range dir.Nodes {
+		child := childInode(inode, "/"+tn.Name)
+		switch node := tn.Node.(type) {
+		case *Dir:
+			node.setStat(child, stat)
+		case *File:
+			node.Inode = child
+			node.Stat = stat
+		}
+	}
+}
+
+// Constants of the 64 bit FNV-1a hash.
+const (
+	fnvOffset = 14695981039346656037
+	fnvPrime  = 1099511628211
+)
+
+// Gets the inode number of the node called name in the directory with
+// inode number parent, by continuing the FNV-1a hash of the path of the
+// directory with name. Inode numbers 0 and 1, which mean no inode and the
+// root of the mount, are never given.
+func childInode(parent uint64, name string) uint64 {
+	h := parent
+	for i := 0; i < len(name); i++ {
+		h ^= uint64(name[i])
+		h *= fnvPrime
+	}
+	if h <= 1 {
+		h += 2
+	}
+	return h
+}
+
+// Gets the attributes of a node with the attributes shared by its tree.
+func (s *Stat) attr(inode uint64, mode os.FileMode, size uint64, nlink uint32) fuse.Attr {
+	a := fuse.Attr{Inode: inode, Mode: mode, Size: size, Nlink: nlink}
+	if s != nil {
+		a.Atime = s.Mtime
+		a.Mtime = s.Mtime
+		a.Ctime = s.Mtime
+		a.Uid = s.Uid
+		a.Gid = s.Gid
+	}
+	return a
+}
+
+// Gets the link count of dir: its entry in its parent, its own "." and
+// the ".." of each directory in it.
+func (dir *Dir) nlink() uint32 {
+	n := uint32(2)
+	for _, tn := range dir.Nodes {
+		if _, ok := tn.Node.(*Dir); ok {
+			n++
+		}
+	}
+	return n
+}
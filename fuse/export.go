@@ -0,0 +1,464 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package pfuse
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"bazil.org/fuse"
+
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+)
+
+// Names of the virtual files that export a whole message, in the order
+// they are listed in each message directory.
+var exportNames = []string{".json", ".textproto", ".bin"}
+
+// Export is a virtual file holding the message of a directory in the
+// format named by Name, generated when it is read.
+type Export struct {
+	Dir  *Dir
+	Name string
+}
+
+func (e *Export) Attr(ctx context.Context, a *fuse.Attr) error {
+	p, _ := e.generate()
+	*a = e.Dir.Stat.attr(childInode(e.Dir.Inode, "/"+e.Name), 0444, uint64(len(p)), 1)
+	return nil
+}
+
+func (e *Export) ReadAll(ctx context.Context) ([]byte, error) {
+	p, err := e.generate()
+	if err != nil {
+		return nil, fuse.EIO
+	}
+	return p, nil
+}
+
+// Generates the export, once per directory as trees do not change.
+func (e *Export) generate() ([]byte, error) {
+	if e.Name == ".bin" {
+		return e.Dir.Raw, nil
+	}
+	dir := e.Dir
+	dir.exportsMu.Lock()
+	defer dir.exportsMu.Unlock()
+	if p, ok := dir.exports[e.Name]; ok {
+		return p, nil
+	}
+	var p []byte
+	var err error
+	switch e.Name {
+	case ".json":
+		p, err = dir.JSON()
+	case ".textproto":
+		p = dir.Text()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if dir.exports == nil {
+		dir.exports = make(map[string][]byte)
+	}
+	dir.exports[e.Name] = p
+	return p, nil
+}
+
+// Gets the export called name, if dir has one.
+func (dir *Dir) export(name string) (*Export, bool) {
+	if dir.Raw == nil {
+		return nil, false
+	}
+	switch name {
+	case ".json", ".textproto":
+		return &Export{Dir: dir, Name: name}, true
+	case ".bin":
+		// the wire bytes would reveal redacted fields
+		if !dir.Redacted {
+			return &Export{Dir: dir, Name: name}, true
+		}
+	}
+	return nil, false
+}
+
+// Gets the nodes of dir, with the elements of repeated fields shown in
+// list directories in place of the directories.
+func (dir *Dir) values() []TreeNode {
+	var nodes []TreeNode
+	for _, tn := range dir.Nodes {
+		if list, ok := tn.Node.(*Dir); ok && list.List {
+			nodes = append(nodes, list.Nodes...)
+			continue
+		}
+		nodes = append(nodes, tn)
+	}
+	return nodes
+}
+
+// Groups the nodes of dir that hold field values by field, in the order
+// the fields first appear.
+func (dir *Dir) fields() [][]TreeNode {
+	var groups [][]TreeNode
+	index := make(map[int32]int)
+	for _, tn := range dir.values() {
+		if tn.View {
+			continue
+		}
+		i, ok := index[tn.FieldNumber]
+		if !ok || tn.Label != google_protobuf.FieldDescriptorProto_LABEL_REPEATED {
+			index[tn.FieldNumber] = len(groups)
+			groups = append(groups, []TreeNode{tn})
+			continue
+		}
+		groups[i] = append(groups[i], tn)
+	}
+	return groups
+}
+
+// JSON renders the message of dir in the proto3 JSON mapping.
+func (dir *Dir) JSON() ([]byte, error) {
+	var b bytes.Buffer
+	dir.writeJSON(&b)
+	var out bytes.Buffer
+	if err := json.Indent(&out, b.Bytes(), "", "  "); err != nil {
+		return nil, err
+	}
+	out.WriteByte('\n')
+	return out.Bytes(), nil
+}
+
+func (dir *Dir) writeJSON(b *bytes.Buffer) {
+	b.WriteByte('{')
+	for i, group := range dir.fields() {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		writeJSONString(b, jsonName(group[0]))
+		b.WriteByte(':')
+		if group[0].Label != google_protobuf.FieldDescriptorProto_LABEL_REPEATED {
+			writeJSONValue(b, group[0])
+			continue
+		}
+		if entry, ok := group[0].Node.(*Dir); ok && entry.MapEntry {
+			writeJSONMap(b, group)
+			continue
+		}
+		b.WriteByte('[')
+		for j, tn := range group {
+			if j > 0 {
+				b.WriteByte(',')
+			}
+			writeJSONValue(b, tn)
+		}
+		b.WriteByte(']')
+	}
+	b.WriteByte('}')
+}
+
+func jsonName(tn TreeNode) string {
+	if tn.Field == nil {
+		return tn.Name
+	}
+	if tn.Field.GetExtendee() != "" {
+		return "[" + tn.Field.GetName() + "]"
+	}
+	return JSONName(tn.Field.GetName())
+}
+
+func writeJSONString(b *bytes.Buffer, s string) {
+	p, _ := json.Marshal(s)
+	b.Write(p)
+}
+
+// Writes the entries of a map field as an object keyed by their keys. An
+// entry without a value, which encoders do not write, has a null value.
+func writeJSONMap(b *bytes.Buffer, entries []TreeNode) {
+	b.WriteByte('{')
+	for i, tn := range entries {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		var key string
+		var value *TreeNode
+		nodes := tn.Node.(*Dir).Nodes
+		for j := range nodes {
+			field := &nodes[j]
+			switch {
+			case field.View:
+			case field.FieldNumber == 1:
+				if file, ok := field.Node.(*File); ok {
+					key = file.value()
+				}
+				if field.Type == google_protobuf.FieldDescriptorProto_TYPE_BOOL {
+					key = strings.ToLower(key)
+				}
+			case field.FieldNumber == 2:
+				value = field
+			}
+		}
+		writeJSONString(b, key)
+		b.WriteByte(':')
+		if value == nil {
+			b.WriteString("null")
+			continue
+		}
+		writeJSONValue(b, *value)
+	}
+	b.WriteByte('}')
+}
+
+func writeJSONValue(b *bytes.Buffer, tn TreeNode) {
+	switch node := tn.Node.(type) {
+	case *Dir:
+		// a bytes field shown as the message it carries
+		if tn.Type == google_protobuf.FieldDescriptorProto_TYPE_BYTES {
+			if node.Redacted {
+				writeJSONString(b, Redacted)
+				return
+			}
+			writeJSONString(b, base64.StdEncoding.EncodeToString(node.Raw))
+			return
+		}
+		node.writeJSON(b)
+		return
+	case *File:
+		if node.Contents == Redacted && node.Raw == nil {
+			writeJSONString(b, node.Contents)
+			return
+		}
+		switch tn.Type {
+		case google_protobuf.FieldDescriptorProto_TYPE_INT32, google_protobuf.FieldDescriptorProto_TYPE_SINT32,
+			google_protobuf.FieldDescriptorProto_TYPE_SFIXED32, google_protobuf.FieldDescriptorProto_TYPE_UINT32,
+			google_protobuf.FieldDescriptorProto_TYPE_FIXED32, google_protobuf.FieldDescriptorProto_TYPE_FLOAT,
+			google_protobuf.FieldDescriptorProto_TYPE_DOUBLE:
+			writeJSONNumber(b, node.value())
+		case google_protobuf.FieldDescriptorProto_TYPE_BOOL:
+			b.WriteString(strings.ToLower(node.value()))
+		case google_protobuf.FieldDescriptorProto_TYPE_BYTES:
+			writeJSONString(b, base64.StdEncoding.EncodeToString(node.Raw))
+		case google_protobuf.FieldDescriptorProto_TYPE_MESSAGE:
+			writeJSONWellKnown(b, tn, node.Contents)
+		default:
+			// 64 bit integers are strings in the JSON mapping
+			writeJSONString(b, node.value())
+		}
+	}
+}
+
+// Writes s as a number, or as a string if it is not one. Infinities and
+// NaN are written as the strings the JSON mapping uses for them.
+func writeJSONNumber(b *bytes.Buffer, s string) {
+	x, err := strconv.ParseFloat(s, 64)
+	switch {
+	case err != nil:
+		writeJSONString(b, s)
+	case math.IsInf(x, 1):
+		writeJSONString(b, "Infinity")
+	case math.IsInf(x, -1):
+		writeJSONString(b, "-Infinity")
+	case math.IsNaN(x):
+		writeJSONString(b, "NaN")
+	default:
+		b.WriteString(s)
+	}
+}
+
+// Writes the JSON form of a well-known type shown as a single file.
+func writeJSONWellKnown(b *bytes.Buffer, tn TreeNode, contents string) {
+	var typeName string
+	if tn.Field != nil {
+		typeName = tn.Field.GetTypeName()
+	}
+	switch typeName {
+	case ".google.protobuf.Struct", ".google.protobuf.Value", ".google.protobuf.ListValue", ".google.protobuf.Empty",
+		".google.protobuf.BoolValue":
+		b.WriteString(contents)
+	case ".google.protobuf.DoubleValue", ".google.protobuf.FloatValue", ".google.protobuf.Int32Value",
+		".google.protobuf.UInt32Value":
+		writeJSONNumber(b, contents)
+	default:
+		writeJSONString(b, contents)
+	}
+}
+
+// Text renders the message of dir in the protocol buffer text format.
+func (dir *Dir) Text() []byte {
+	var b bytes.Buffer
+	dir.writeText(&b, "")
+	return b.Bytes()
+}
+
+func (dir *Dir) writeText(b *bytes.Buffer, indent string) {
+	nodes := dir.Nodes
+	// an expanded google.protobuf.Any
+	if len(nodes) > 0 && nodes[0].FieldNumber == TypeURLFieldNumber {
+		if f, ok := nodes[0].Node.(*File); ok {
+			fmt.Fprintf(b, "%s[%s] {\n", indent, f.Contents)
+			(&Dir{Nodes: nodes[1:]}).writeText(b, indent+"  ")
+			fmt.Fprintf(b, "%s}\n", indent)
+			return
+		}
+	}
+	for _, tn := range dir.values() {
+		if tn.View {
+			continue
+		}
+		name := tn.Name
+		if tn.Field != nil {
+			name = tn.Field.GetName()
+			if tn.Field.GetExtendee() != "" {
+				name = "[" + name + "]"
+			}
+		}
+		switch node := tn.Node.(type) {
+		case *Dir:
+			if tn.Type == google_protobuf.FieldDescriptorProto_TYPE_BYTES {
+				value := strconv.Quote(Redacted)
+				if !node.Redacted {
+					value = textBytes(node.Raw)
+				}
+				fmt.Fprintf(b, "%s%s: %s\n", indent, name, value)
+				continue
+			}
+			fmt.Fprintf(b, "%s%s {\n", indent, name)
+			node.writeText(b, indent+"  ")
+			fmt.Fprintf(b, "%s}\n", indent)
+		case *File:
+			if node.Message != nil {
+				fmt.Fprintf(b, "%s%s {\n", indent, name)
+				node.Message.writeText(b, indent+"  ")
+				fmt.Fprintf(b, "%s}\n", indent)
+				continue
+			}
+			fmt.Fprintf(b, "%s%s: %s\n", indent, name, textValue(tn, node))
+		}
+	}
+}
+
+func textValue(tn TreeNode, file *File) string {
+	if file.Contents == Redacted && file.Raw == nil {
+		return strconv.Quote(file.Contents)
+	}
+	switch tn.Type {
+	case google_protobuf.FieldDescriptorProto_TYPE_STRING:
+		return strconv.Quote(file.Contents)
+	case google_protobuf.FieldDescriptorProto_TYPE_BYTES:
+		return textBytes(file.Raw)
+	case google_protobuf.FieldDescriptorProto_TYPE_BOOL:
+		return strings.ToLower(file.Contents)
+	case google_protobuf.FieldDescriptorProto_TYPE_ENUM:
+		return file.Contents
+	}
+	x, err := strconv.ParseFloat(file.value(), 64)
+	switch {
+	case err != nil:
+		return strconv.Quote(file.value())
+	case math.IsInf(x, 1):
+		return "inf"
+	case math.IsInf(x, -1):
+		return "-inf"
+	case math.IsNaN(x):
+		return "nan"
+	}
+	return file.value()
+}
+
+// Quotes p as the text format does, with octal escapes for unprintable bytes.
+func textBytes(p []byte) string {
+	var b bytes.Buffer
+	b.WriteByte('"')
+	for _, c := range p {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c >= 0x20 && c < 0x7f:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "\\%03o", c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// JSONName converts a field name to lowerCamelCase, as protoc does for the
+// JSON names of fields.
+func JSONName(name string) string {
+	var b []byte
+	upper := false
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c == '_':
+			upper = true
+		case upper && 'a' <= c && c <= 'z':
+			b = append(b, c-'a'+'A')
+			upper = false
+		default:
+			b = append(b, c)
+			upper = false
+		}
+	}
+	return string(b)
+}
+
+// WriteTree writes the tree below dir to w in the style of tree(1), with
+// the contents of each file after its name.
+func (dir *Dir) WriteTree(w io.Writer) error {
+	var b bytes.Buffer
+	b.WriteString(".\n")
+	dir.writeTree(&b, "")
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func (dir *Dir) writeTree(b *bytes.Buffer, prefix string) {
+	for i, tn := range dir.Nodes {
+		branch, indent := "├── ", "│   "
+		if i == len(dir.Nodes)-1 {
+			branch, indent = "└── ", "    "
+		}
+		switch node := tn.Node.(type) {
+		case *Dir:
+			fmt.Fprintf(b, "%s%s%s\n", prefix, branch, tn.Name)
+			node.writeTree(b, prefix+indent)
+		case *File:
+			fmt.Fprintf(b, "%s%s%s: %s\n", prefix, branch, tn.Name, treeValue(node.Contents))
+		}
+	}
+}
+
+// Shows contents on a single line, quoting it if it would span several
+// lines or contains unprintable characters.
+func treeValue(contents string) string {
+	for _, r := range contents {
+		if !unicode.IsPrint(r) {
+			return strconv.Quote(contents)
+		}
+	}
+	return contents
+}
@@ -0,0 +1,57 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package pfuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Extract writes the tree under dir to the directory path as it would be
+// shown by the mount, exports included, creating path if needed.
+func (dir *Dir) Extract(path string) error {
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		return err
+	}
+	for _, tn := range dir.Nodes {
+		name := filepath.Join(path, tn.Name)
+		switch node := tn.Node.(type) {
+		case *Dir:
+			err = node.Extract(name)
+		case *File:
+			err = ioutil.WriteFile(name, []byte(node.Contents), 0644)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range exportNames {
+		e, ok := dir.export(name)
+		if !ok {
+			continue
+		}
+		p, err := e.generate()
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(filepath.Join(path, name), p, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package pfuse
+
+import (
+	"context"
+	"sync"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// Live is a filesystem whose tree can be replaced while it is mounted. Its
+// root directory is the same node throughout and shows the current tree.
+type Live struct {
+	mu  sync.RWMutex
+	dir *Dir
+}
+
+func NewLive(PT *ProtoTree) *Live {
+	return &Live{dir: &PT.Dir}
+}
+
+// Invalidation is something the kernel may have cached of a replaced tree:
+// the entry Name of the directory Node, or the data of Node if Name is
+// empty.
+type Invalidation struct {
+	Node fs.Node
+	Name string
+}
+
+// Swap replaces the tree, returning what the kernel may have cached of the
+// old one that the new one changes: the entries of the names that were
+// removed or now show something else, at any depth, and the data of the
+// old nodes behind them. Unchanged nodes of the old tree stay in use until
+// the kernel forgets them.
+func (l *Live) Swap(PT *ProtoTree) []Invalidation {
+	l.mu.Lock()
+	old := l.dir
+	l.dir = &PT.Dir
+	l.mu.Unlock()
+
+	var inv []Invalidation
+	diffDir(l, old, &PT.Dir, &inv)
+	return inv
+}
+
+// Appends to inv what must be invalidated for the directory old, known to
+// the kernel as node, to show new instead, reporting whether they differ.
+func diffDir(node fs.Node, old *Dir, new *Dir, inv *[]Invalidation) bool {
+	changed := len(old.Nodes) != len(new.Nodes) || old.Redacted != new.Redacted || (old.Raw == nil) != (new.Raw == nil)
+	newNodes := make(map[string]fs.Node, len(new.Nodes))
+	for i, tn := range new.Nodes {
+		if _, ok := newNodes[tn.Name]; !ok {
+			newNodes[tn.Name] = tn.Node
+		}
+		if i < len(old.Nodes) && old.Nodes[i].Name != tn.Name {
+			changed = true
+		}
+	}
+	seen := make(map[string]bool, len(old.Nodes))
+	for _, tn := range old.Nodes {
+		// lookups find the first node of a repeated name
+		if seen[tn.Name] {
+			continue
+		}
+		seen[tn.Name] = true
+		next, ok := newNodes[tn.Name]
+		if !ok || diffNode(tn.Node, next, inv) {
+			changed = true
+			*inv = append(*inv, Invalidation{Node: node, Name: tn.Name}, Invalidation{Node: tn.Node})
+		}
+	}
+	if changed {
+		for _, name := range exportNames {
+			if _, ok := old.export(name); ok {
+				*inv = append(*inv, Invalidation{Node: node, Name: name})
+			}
+		}
+	}
+	return changed
+}
+
+// Reports whether the node old of the replaced tree differs from new,
+// appending to inv what must be invalidated below old if it is a directory,
+// as processes may still be looking up names through it.
+func diffNode(old fs.Node, new fs.Node, inv *[]Invalidation) bool {
+	switch o := old.(type) {
+	case *Dir:
+		n, ok := new.(*Dir)
+		return !ok || diffDir(o, o, n, inv)
+	case *File:
+		n, ok := new.(*File)
+		return !ok || o.Contents != n.Contents || o.Value != n.Value
+	}
+	return true
+}
+
+// Gets the root directory of the current tree.
+func (l *Live) current() *Dir {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.dir
+}
+
+func (l *Live) Root() (fs.Node, error) {
+	return l, nil
+}
+
+func (l *Live) Attr(ctx context.Context, a *fuse.Attr) error {
+	l.current().Attr(ctx, a)
+	a.Inode = 1
+	return nil
+}
+
+func (l *Live) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	return l.current().Lookup(ctx, name)
+}
+
+func (l *Live) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return l.current().ReadDirAll(ctx)
+}
@@ -0,0 +1,260 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package pfuse
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// Name of the file at the root of a Multi that sources are added and
+// removed through.
+const ControlName = ".control"
+
+// Multi is a filesystem showing several trees, each in a directory at its
+// root named after the source it was read from. Sources can be added and
+// removed while it is mounted by writing commands to the .control file at
+// its root, which lists the sources when read.
+type Multi struct {
+	mu      sync.RWMutex
+	sources map[string]*multiSource
+	// stat gives the time sources were last added or removed
+	stat Stat
+	// err is the error of the last command written to .control
+	err error
+	// run runs a command written to .control; runMu makes commands written
+	// at the same time run one after the other
+	run   func(command string) error
+	runMu sync.Mutex
+	file  *control
+	// Invalidate, if set, is called with the name of each source added or
+	// removed, to drop what the kernel has cached of it.
+	Invalidate func(name string)
+}
+
+type multiSource struct {
+	dir         *Dir
+	description string
+}
+
+// NewMulti makes an empty Multi, running the commands written to its
+// .control file, one per line, with run.
+func NewMulti(run func(command string) error) *Multi {
+	m := &Multi{sources: make(map[string]*multiSource), run: run, stat: NewStat(time.Now())}
+	m.file = &control{m}
+	return m
+}
+
+// Add shows PT in a directory called name, replacing any source of that
+// name. description is shown for it in .control.
+func (m *Multi) Add(name string, description string, PT *ProtoTree) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.Contains(name, "/") {
+		return fmt.Errorf("Invalid source name: %q", name)
+	}
+	// number the nodes of each source apart from those of the others
+	stat := NewStat(time.Now())
+	if PT.Dir.Stat != nil {
+		stat = *PT.Dir.Stat
+	}
+	PT.SetStat("/"+name, stat)
+	m.mu.Lock()
+	m.sources[name] = &multiSource{dir: &PT.Dir, description: description}
+	m.stat.Mtime = time.Now()
+	m.mu.Unlock()
+	m.invalidate(name)
+	return nil
+}
+
+// Remove stops showing the source called name.
+func (m *Multi) Remove(name string) error {
+	m.mu.Lock()
+	_, ok := m.sources[name]
+	delete(m.sources, name)
+	m.stat.Mtime = time.Now()
+	m.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("No such source: %s", name)
+	}
+	m.invalidate(name)
+	return nil
+}
+
+func (m *Multi) invalidate(name string) {
+	if m.Invalidate != nil {
+		m.Invalidate(name)
+	}
+}
+
+// Gets the names of the sources in order. m.mu must be held.
+func (m *Multi) names() []string {
+	names := make([]string, 0, len(m.sources))
+	for name := range m.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *Multi) Root() (fs.Node, error) {
+	return m, nil
+}
+
+func (m *Multi) Attr(ctx context.Context, a *fuse.Attr) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	*a = m.stat.attr(1, os.ModeDir|0555, 0, uint32(2+len(m.sources)))
+	return nil
+}
+
+func (m *Multi) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if name == ControlName {
+		return m.file, nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if source, ok := m.sources[name]; ok {
+		return source.dir, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+func (m *Multi) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	dirs := []fuse.Dirent{{Name: ControlName, Type: fuse.DT_File, Inode: childInode(fnvOffset, "/"+ControlName)}}
+	for _, name := range m.names() {
+		dirs = append(dirs, dirent(ctx, name, m.sources[name].dir))
+	}
+	return dirs, nil
+}
+
+// control is the .control file of a Multi.
+type control struct {
+	m *Multi
+}
+
+// Gets the contents of .control: a line describing each source, followed
+// by the error of the last command if it failed.
+func (c *control) contents() string {
+	var lines []string
+	c.m.mu.RLock()
+	for _, name := range c.m.names() {
+		lines = append(lines, c.m.sources[name].description+"\n")
+	}
+	if c.m.err != nil {
+		lines = append(lines, "error: "+c.m.err.Error()+"\n")
+	}
+	c.m.mu.RUnlock()
+	return strings.Join(lines, "")
+}
+
+func (c *control) Attr(ctx context.Context, a *fuse.Attr) error {
+	size := uint64(len(c.contents()))
+	c.m.mu.RLock()
+	defer c.m.mu.RUnlock()
+	*a = c.m.stat.attr(childInode(fnvOffset, "/"+ControlName), 0644, size, 1)
+	return nil
+}
+
+// Truncating .control, as shells do when writing to it, does nothing.
+func (c *control) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	return c.Attr(ctx, &resp.Attr)
+}
+
+// Each opening of .control gets a handle of its own, so that commands
+// written through it in several writes are put back together.
+func (c *control) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	return &controlHandle{c: c}, nil
+}
+
+// controlHandle is an open .control file.
+type controlHandle struct {
+	c *control
+	// mu guards partial, the start of a command whose line has not been
+	// ended yet
+	mu      sync.Mutex
+	partial []byte
+}
+
+func (h *controlHandle) ReadAll(ctx context.Context) ([]byte, error) {
+	return []byte(h.c.contents()), nil
+}
+
+// Runs the commands in the lines completed by the data written. A failing
+// command fails the write, and its error is shown in .control.
+func (h *controlHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.partial = append(h.partial, req.Data...)
+	end := bytes.LastIndexByte(h.partial, '\n') + 1
+	lines := string(h.partial[:end])
+	h.partial = h.partial[end:]
+	if err := h.c.run(lines); err != nil {
+		return err
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
+
+// Runs a last command written without an ending newline when the file is
+// closed.
+func (h *controlHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	lines := string(h.partial)
+	h.partial = nil
+	return h.c.run(lines)
+}
+
+// Runs the commands in lines, stopping at the first that fails, and records
+// the outcome for .control.
+func (c *control) run(lines string) error {
+	// only writes that end a line, and closes after a partial one, run
+	// commands
+	if strings.TrimSpace(lines) == "" {
+		return nil
+	}
+	c.m.runMu.Lock()
+	defer c.m.runMu.Unlock()
+	var err error
+	for _, line := range strings.Split(lines, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if err = c.m.run(line); err != nil {
+			log.Printf("%s: %v", ControlName, err)
+			break
+		}
+	}
+	c.m.mu.Lock()
+	c.m.err = err
+	c.m.mu.Unlock()
+	if err != nil {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	return nil
+}
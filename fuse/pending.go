@@ -0,0 +1,92 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package pfuse
+
+import (
+	"context"
+	"os"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// Pending is a filesystem whose tree is not known when it is mounted, such
+// as one read from a pipe. Its root directory waits for the tree to be set
+// before answering lookups.
+type Pending struct {
+	ready chan struct{}
+	dir   *Dir
+	err   error
+}
+
+func NewPending() *Pending {
+	return &Pending{ready: make(chan struct{})}
+}
+
+// Set provides the tree, or the error that prevented building it. It must
+// be called exactly once.
+func (p *Pending) Set(PT *ProtoTree, err error) {
+	if err == nil {
+		p.dir = &PT.Dir
+	}
+	p.err = err
+	close(p.ready)
+}
+
+func (p *Pending) Root() (fs.Node, error) {
+	return p, nil
+}
+
+func (p *Pending) Attr(ctx context.Context, a *fuse.Attr) error {
+	select {
+	case <-p.ready:
+		if p.dir != nil {
+			p.dir.Attr(ctx, a)
+			a.Inode = 1
+			return nil
+		}
+	default:
+	}
+	*a = fuse.Attr{Inode: 1, Mode: os.ModeDir | 0555, Nlink: 2}
+	return nil
+}
+
+// Waits for the tree, giving up if the request is interrupted.
+func (p *Pending) wait(ctx context.Context) error {
+	select {
+	case <-p.ready:
+	case <-ctx.Done():
+		return fuse.Errno(syscall.EINTR)
+	}
+	if p.err != nil {
+		return fuse.EIO
+	}
+	return nil
+}
+
+func (p *Pending) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if err := p.wait(ctx); err != nil {
+		return nil, err
+	}
+	return p.dir.Lookup(ctx, name)
+}
+
+func (p *Pending) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	if err := p.wait(ctx); err != nil {
+		return nil, err
+	}
+	return p.dir.ReadDirAll(ctx)
+}
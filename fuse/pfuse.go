@@ -17,7 +17,9 @@ package pfuse
 import (
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
+	"context"
 	"os"
+	"sync"
 
 	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
 )
@@ -26,7 +28,7 @@ type ProtoTree struct {
 	Dir
 }
 
-func (t *ProtoTree) Root() (fs.Node, fuse.Error) {
+func (t *ProtoTree) Root() (fs.Node, error) {
 	return &t.Dir, nil
 }
 
@@ -37,43 +39,136 @@ type TreeNode struct {
 	Type        google_protobuf.FieldDescriptorProto_Type
 	Label		google_protobuf.FieldDescriptorProto_Label
 	Node        fs.Node
+	// Field is the descriptor of the field the node was decoded from.
+	Field *google_protobuf.FieldDescriptorProto
+	// View is set on alternate renderings of the preceding node.
+	View bool
 }
 
+// TypeURLFieldNumber is the FieldNumber of the @type node shown in an
+// expanded google.protobuf.Any. It is not the number of any field, so the
+// node is never taken for a field of the message the Any holds.
+const TypeURLFieldNumber int32 = -1
+
 // Dir implements both Node and Handle for the directories.
 type Dir struct {
 	Nodes []TreeNode
+	// Raw holds the wire bytes of the message shown by the directory,
+	// and is nil for directories that do not show a message.
+	Raw []byte
+	// Redacted is set if the message contains redacted fields.
+	Redacted bool
+	// List is set on directories holding the elements of a repeated field,
+	// which are part of the message of the directory above.
+	List bool
+	// MapEntry is set on directories holding an entry of a map field, which
+	// the JSON mapping renders as a member of an object.
+	MapEntry bool
+	// Inode and Stat are set by SetStat.
+	Inode uint64
+	Stat  *Stat
+	// Meta describes the field the directory shows, if any.
+	Meta *FieldMeta
+	// exports caches the generated exports of the directory by name.
+	exportsMu sync.Mutex
+	exports   map[string][]byte
+	// index maps the names of Nodes to their positions. It is built on the
+	// first lookup, after which Nodes must not change.
+	index     map[string]int
+	indexOnce sync.Once
 }
 
-func (dir *Dir) Attr() fuse.Attr {
-	return fuse.Attr{Mode: os.ModeDir | 0555}
+func (dir *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
+	*a = dir.Stat.attr(dir.Inode, os.ModeDir|0555, 0, dir.nlink())
+	return nil
 }
 
-func (dir *Dir) Lookup(name string, intr fs.Intr) (fs.Node, fuse.Error) {
-	for _, treenode := range dir.Nodes {
-		if name == treenode.Name {
-			return treenode.Node, nil
-		}
+func (dir *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	dir.indexOnce.Do(dir.buildIndex)
+	if i, ok := dir.index[name]; ok {
+		return dir.Nodes[i].Node, nil
+	}
+	if e, ok := dir.export(name); ok {
+		return e, nil
 	}
 	return nil, fuse.ENOENT
 }
 
-func (dir *Dir) ReadDir(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
-	var dirs []fuse.Dirent
+// Indexes the nodes of dir by name. Where names repeat, the first node of
+// the name is found, as before indexing.
+func (dir *Dir) buildIndex() {
+	dir.index = make(map[string]int, len(dir.Nodes))
+	for i, treenode := range dir.Nodes {
+		if _, ok := dir.index[treenode.Name]; !ok {
+			dir.index[treenode.Name] = i
+		}
+	}
+}
+
+func (dir *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	dirs := make([]fuse.Dirent, 0, len(dir.Nodes)+len(exportNames))
 	for _, treenode := range dir.Nodes {
-		dirs = append(dirs, fuse.Dirent{Name: treenode.Name})
+		dirs = append(dirs, dirent(ctx, treenode.Name, treenode.Node))
+	}
+	for _, name := range exportNames {
+		if _, ok := dir.export(name); ok {
+			dirs = append(dirs, fuse.Dirent{Name: name, Type: fuse.DT_File, Inode: childInode(dir.Inode, "/"+name)})
+		}
 	}
 	return dirs, nil
 }
 
+// Gets the directory entry of node, with its type and inode number so that
+// listing a directory tells files from directories without a stat of each.
+func dirent(ctx context.Context, name string, node fs.Node) fuse.Dirent {
+	switch n := node.(type) {
+	case *Dir:
+		return fuse.Dirent{Name: name, Type: fuse.DT_Dir, Inode: n.Inode}
+	case *File:
+		return fuse.Dirent{Name: name, Type: fuse.DT_File, Inode: n.Inode}
+	}
+	var a fuse.Attr
+	node.Attr(ctx, &a)
+	d := fuse.Dirent{Name: name, Type: fuse.DT_File, Inode: a.Inode}
+	if a.Mode.IsDir() {
+		d.Type = fuse.DT_Dir
+	}
+	return d
+}
+
 // File implements both Node and Handle for the files.
 type File struct {
 	Contents string
+	// Raw holds the undecoded value of bytes fields.
+	Raw []byte
+	// Message holds the fields of a well-known type shown as a single file.
+	Message *Dir
+	// Value holds the decoded value of a field whose unit or format option
+	// changed Contents. Exports use it in place of Contents.
+	Value string
+	// Inode and Stat are set by SetStat.
+	Inode uint64
+	Stat  *Stat
+	// Meta describes the field the file shows, if any.
+	Meta *FieldMeta
 }
 
-func (file *File) Attr() fuse.Attr {
-	return fuse.Attr{Mode: 0444, Size: uint64(len(file.Contents))}
+// Contents of the files of redacted fields.
+const Redacted = "REDACTED"
+
+func (file *File) Attr(ctx context.Context, a *fuse.Attr) error {
+	*a = file.Stat.attr(file.Inode, 0444, uint64(len(file.Contents)), 1)
+	return nil
 }
 
-func (file *File) ReadAll(intr fs.Intr) ([]byte, fuse.Error) {
+func (file *File) ReadAll(ctx context.Context) ([]byte, error) {
 	return []byte(file.Contents), nil
 }
+
+// Gets the decoded value of file, without the annotations of its field.
+func (file *File) value() string {
+	if file.Value != "" {
+		return file.Value
+	}
+	return file.Contents
+}
@@ -0,0 +1,354 @@
+package pfuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+)
+
+// Builds a small tree holding a message with a field and a repeated
+// message field.
+func testTree() *ProtoTree {
+	return &ProtoTree{Dir{Nodes: []TreeNode{
+		{Name: "Message_1", Node: &Dir{Nodes: []TreeNode{
+			{Name: "f1", Node: &File{Contents: "1"}},
+			{Name: "f2", Node: &Dir{List: true, Nodes: []TreeNode{
+				{Name: "0", Node: &Dir{}},
+				{Name: "1", Node: &Dir{}},
+			}}},
+		}}},
+	}}}
+}
+
+// Gets the attributes of node.
+func attr(node fs.Node) fuse.Attr {
+	var a fuse.Attr
+	node.Attr(context.Background(), &a)
+	return a
+}
+
+func TestSetStat(t *testing.T) {
+	mtime := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	PT := testTree()
+	PT.SetStat("", NewStat(mtime))
+	message := PT.Dir.Nodes[0].Node.(*Dir)
+	f1 := message.Nodes[0].Node.(*File)
+	f2 := message.Nodes[1].Node.(*Dir)
+
+	a := attr(f1)
+	if !a.Mtime.Equal(mtime) || a.Uid != uint32(os.Getuid()) || a.Gid != uint32(os.Getgid()) || a.Nlink != 1 {
+		t.Error(fmt.Sprintf("Unexpected file attributes: %+v", a))
+	}
+	// each directory is linked from its parent, itself and its subdirectories
+	if n := attr(&PT.Dir).Nlink; n != 3 {
+		t.Error(fmt.Sprintf("Expected 3 links to the root, got %d", n))
+	}
+	if n := attr(message).Nlink; n != 3 {
+		t.Error(fmt.Sprintf("Expected 3 links to Message_1, got %d", n))
+	}
+	if n := attr(f2).Nlink; n != 4 {
+		t.Error(fmt.Sprintf("Expected 4 links to f2, got %d", n))
+	}
+
+	// inode numbers differ between nodes and follow the path
+	inodes := map[uint64]bool{PT.Dir.Inode: true, message.Inode: true, f1.Inode: true, f2.Inode: true}
+	if len(inodes) != 4 || inodes[0] || inodes[1] {
+		t.Error(fmt.Sprintf("Inode numbers not distinct: %v", inodes))
+	}
+	again := testTree()
+	again.SetStat("", NewStat(time.Now()))
+	if again.Dir.Nodes[0].Node.(*Dir).Nodes[0].Node.(*File).Inode != f1.Inode {
+		t.Error("Inode number of the same path changed between trees")
+	}
+	other := testTree()
+	other.SetStat("/other", NewStat(mtime))
+	if other.Dir.Nodes[0].Node.(*Dir).Nodes[0].Node.(*File).Inode == f1.Inode {
+		t.Error("Inode number unchanged by a different root")
+	}
+}
+
+// Builds a directory holding n elements of a repeated field.
+func largeDir(n int) *Dir {
+	dir := &Dir{Raw: []byte{}}
+	for i := 1; i <= n; i++ {
+		dir.Nodes = append(dir.Nodes, TreeNode{Name: fmt.Sprintf("f2_%d", i), Node: &File{Contents: strconv.Itoa(i)}})
+	}
+	return dir
+}
+
+func TestLookup(t *testing.T) {
+	dir := largeDir(10)
+	dir.Nodes = append(dir.Nodes, TreeNode{Name: "f2_1", Node: &File{Contents: "duplicate"}})
+	node, err := dir.Lookup(context.Background(), "f2_1")
+	if err != nil || node.(*File).Contents != "1" {
+		t.Error(fmt.Sprintf("Expected the first f2_1, got %v, %v", node, err))
+	}
+	if node, err := dir.Lookup(context.Background(), "f2_10"); err != nil || node.(*File).Contents != "10" {
+		t.Error(fmt.Sprintf("Expected f2_10, got %v, %v", node, err))
+	}
+	if _, err := dir.Lookup(context.Background(), ".json"); err != nil {
+		t.Error(fmt.Sprintf("Expected the .json export, got %v", err))
+	}
+	if _, err := dir.Lookup(context.Background(), "f2_11"); err == nil {
+		t.Error("Expected f2_11 not to be found")
+	}
+}
+
+func TestExportCache(t *testing.T) {
+	dir := &Dir{Raw: []byte{}, Nodes: []TreeNode{{Name: "f1", FieldNumber: 1, Node: &File{Contents: "1"}}}}
+	e, _ := dir.export(".json")
+	a := attr(e)
+	// a stat and a read of the export, even through another node, agree
+	// and generate it once
+	p, err := (&Export{Dir: dir, Name: ".json"}).ReadAll(context.Background())
+	if err != nil || uint64(len(p)) != a.Size {
+		t.Fatal(fmt.Sprintf("Export of %d bytes read as %q, %v", a.Size, p, err))
+	}
+	dir.Nodes = nil
+	if again, _ := e.ReadAll(context.Background()); string(again) != string(p) {
+		t.Error(fmt.Sprintf("Expected the export to be generated once, got %q then %q", p, again))
+	}
+}
+
+func TestControl(t *testing.T) {
+	ctx := context.Background()
+	var m *Multi
+	var commands []string
+	m = NewMulti(func(command string) error {
+		commands = append(commands, command)
+		fields := strings.Fields(command)
+		switch fields[0] {
+		case "add":
+			return m.Add(fields[1], "source "+fields[1], testTree())
+		case "remove":
+			return m.Remove(fields[1])
+		}
+		return fmt.Errorf("Unknown command %q", command)
+	})
+	node, err := m.Lookup(ctx, ControlName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := node.(fs.NodeOpener).Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(s string) error {
+		return h.(fs.HandleWriter).Write(ctx, &fuse.WriteRequest{Data: []byte(s)}, &fuse.WriteResponse{})
+	}
+	names := func() []string {
+		dirents, _ := m.ReadDirAll(ctx)
+		var names []string
+		for _, d := range dirents {
+			names = append(names, d.Name)
+		}
+		return names
+	}
+
+	// commands run once their line is ended, however they are split
+	for _, s := range []string{"add a", "\nadd ", "b\nremove a"} {
+		if err := write(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(commands, []string{"add a", "add b"}) {
+		t.Error(fmt.Sprintf("Unexpected commands: %q", commands))
+	}
+	if got := names(); !reflect.DeepEqual(got, []string{ControlName, "a", "b"}) {
+		t.Error(fmt.Sprintf("Unexpected sources after adding: %v", got))
+	}
+	// closing the file runs the last command
+	if err := h.(fs.HandleFlusher).Flush(ctx, &fuse.FlushRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(); !reflect.DeepEqual(got, []string{ControlName, "b"}) {
+		t.Error(fmt.Sprintf("Unexpected sources after removing: %v", got))
+	}
+	if p, _ := h.(fs.HandleReadAller).ReadAll(ctx); string(p) != "source b\n" {
+		t.Error(fmt.Sprintf("Unexpected contents of %s: %q", ControlName, p))
+	}
+
+	if err := write("remove c\n"); err == nil {
+		t.Error("Expected removing a missing source to fail the write")
+	}
+	if p, _ := h.(fs.HandleReadAller).ReadAll(ctx); !strings.HasSuffix(string(p), "error: No such source: c\n") {
+		t.Error(fmt.Sprintf("Expected the error in %s, got %q", ControlName, p))
+	}
+}
+
+func TestPending(t *testing.T) {
+	ctx := context.Background()
+
+	// a lookup blocks until the tree is set
+	p := NewPending()
+	type result struct {
+		node fs.Node
+		err  error
+	}
+	results := make(chan result)
+	go func() {
+		node, err := p.Lookup(ctx, "Message_1")
+		results <- result{node, err}
+	}()
+	select {
+	case r := <-results:
+		t.Fatal(fmt.Sprintf("Lookup returned before the tree was set: %v, %v", r.node, r.err))
+	case <-time.After(10 * time.Millisecond):
+	}
+	PT := testTree()
+	p.Set(PT, nil)
+	select {
+	case r := <-results:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if r.node != PT.Dir.Nodes[0].Node {
+			t.Error(fmt.Sprintf("Expected Message_1 of the tree, got %v", r.node))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Lookup still blocked after the tree was set")
+	}
+	if dirents, err := p.ReadDirAll(ctx); err != nil || len(dirents) != 1 || dirents[0].Name != "Message_1" {
+		t.Error(fmt.Sprintf("Unexpected root entries: %v, %v", dirents, err))
+	}
+	if a := attr(p); a.Inode != 1 || !a.Mode.IsDir() {
+		t.Error(fmt.Sprintf("Unexpected root attributes: %v", a))
+	}
+
+	// a tree that could not be built fails blocked and later reads
+	p = NewPending()
+	errs := make(chan error)
+	go func() {
+		_, err := p.ReadDirAll(ctx)
+		errs <- err
+	}()
+	p.Set(nil, errors.New("Bad input"))
+	if err := <-errs; err != fuse.EIO {
+		t.Error(fmt.Sprintf("Expected EIO from a blocked read, got %v", err))
+	}
+	if _, err := p.Lookup(ctx, "Message_1"); err != fuse.EIO {
+		t.Error(fmt.Sprintf("Expected EIO from a later lookup, got %v", err))
+	}
+
+	// an interrupted request stops waiting
+	p = NewPending()
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := p.Lookup(cancelled, "Message_1"); err != fuse.Errno(syscall.EINTR) {
+		t.Error(fmt.Sprintf("Expected EINTR from an interrupted lookup, got %v", err))
+	}
+}
+
+func TestSwap(t *testing.T) {
+	old := testTree()
+	l := NewLive(old)
+	message := old.Dir.Nodes[0].Node.(*Dir)
+
+	// f1 changes and f2 is unchanged, so only f1 and the message holding
+	// it are invalidated
+	changed := func() *ProtoTree {
+		PT := testTree()
+		PT.Dir.Nodes[0].Node.(*Dir).Nodes[0].Node = &File{Contents: "2"}
+		return PT
+	}
+	PT := changed()
+	expected := []Invalidation{
+		{Node: message, Name: "f1"}, {Node: message.Nodes[0].Node},
+		{Node: l, Name: "Message_1"}, {Node: message},
+	}
+	check := func(invalidations []Invalidation) {
+		if len(invalidations) != len(expected) {
+			t.Fatal(fmt.Sprintf("Expected %d invalidations, got %v", len(expected), invalidations))
+		}
+		for i, inv := range invalidations {
+			if inv != expected[i] {
+				t.Error(fmt.Sprintf("Invalidation %d is %v, expected %v", i, inv, expected[i]))
+			}
+		}
+	}
+	check(l.Swap(PT))
+	if node, _ := l.Lookup(context.Background(), "Message_1"); node != PT.Dir.Nodes[0].Node {
+		t.Error("Lookup found the old tree after swapping")
+	}
+
+	// swapping in an equal tree changes nothing
+	expected = nil
+	check(l.Swap(changed()))
+
+	// a removed name is invalidated along with what was below it
+	current := l.current()
+	expected = []Invalidation{{Node: l, Name: "Message_1"}, {Node: current.Nodes[0].Node}}
+	check(l.Swap(&ProtoTree{}))
+}
+
+func TestXattr(t *testing.T) {
+	field := &google_protobuf.FieldDescriptorProto{
+		Name:         proto.String("user_id"),
+		Number:       proto.Int32(3),
+		Type:         google_protobuf.FieldDescriptorProto_TYPE_INT64.Enum(),
+		Label:        google_protobuf.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		DefaultValue: proto.String("7"),
+	}
+	file := &File{Contents: "7", Meta: &FieldMeta{Descriptor: field, FullName: "test.foo.user_id", Oneof: "owner", Comments: "The owner."}}
+
+	list := &fuse.ListxattrResponse{}
+	if err := file.Listxattr(context.Background(), &fuse.ListxattrRequest{}, list); err != nil {
+		t.Fatal(err)
+	}
+	expected := "user.protobuf.name\x00user.protobuf.number\x00user.protobuf.type\x00user.protobuf.label\x00" +
+		"user.protobuf.json_name\x00user.protobuf.oneof\x00user.protobuf.default\x00user.protobuf.comment\x00"
+	if string(list.Xattr) != expected {
+		t.Error(fmt.Sprintf("Attribute names don't match: %q", list.Xattr))
+	}
+	for name, value := range map[string]string{"number": "3", "type": "int64", "label": "optional", "json_name": "userId", "oneof": "owner"} {
+		resp := &fuse.GetxattrResponse{}
+		if err := file.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: "user.protobuf." + name}, resp); err != nil || string(resp.Xattr) != value {
+			t.Error(fmt.Sprintf("Expected %s to be %s, got %q, %v", name, value, resp.Xattr, err))
+		}
+	}
+	if err := file.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: "user.protobuf.type_name"}, &fuse.GetxattrResponse{}); err != fuse.ErrNoXattr {
+		t.Error(fmt.Sprintf("Expected no type_name, got %v", err))
+	}
+	if err := (&Dir{}).Listxattr(context.Background(), &fuse.ListxattrRequest{}, &fuse.ListxattrResponse{}); err != nil {
+		t.Error(err)
+	}
+
+	// a json_name option overrides the derived name
+	field.JsonName = proto.String("owner")
+	resp := &fuse.GetxattrResponse{}
+	if err := file.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: "user.protobuf.json_name"}, resp); err != nil || string(resp.Xattr) != "owner" {
+		t.Error(fmt.Sprintf("Expected json_name to be owner, got %q, %v", resp.Xattr, err))
+	}
+}
+
+func BenchmarkLookup(b *testing.B) {
+	dir := largeDir(50000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := dir.Lookup(context.Background(), fmt.Sprintf("f2_%d", 40000+i%10000)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadDir(b *testing.B) {
+	dir := largeDir(50000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := dir.ReadDirAll(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
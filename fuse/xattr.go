@@ -0,0 +1,119 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package pfuse
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"bazil.org/fuse"
+
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+)
+
+// FieldMeta describes the field a node was decoded from. It is shown in
+// the extended attributes of the node.
+type FieldMeta struct {
+	Descriptor *google_protobuf.FieldDescriptorProto
+	// FullName is the fully qualified name of the field, without a
+	// leading dot.
+	FullName string
+	// Oneof is the name of the oneof the field is part of, if any.
+	Oneof string
+	// Comments are the leading comments of the field in its .proto file.
+	Comments string
+}
+
+// Prefix of the names of the extended attributes. Attributes outside the
+// user namespace cannot be read by unprivileged users on Linux.
+const xattrPrefix = "user.protobuf."
+
+// xattr is an extended attribute of a node.
+type xattr struct {
+	name  string
+	value string
+}
+
+// Gets the extended attributes describing the field of m, leaving out
+// those that do not apply.
+func (m *FieldMeta) xattrs() []xattr {
+	if m == nil || m.Descriptor == nil {
+		return nil
+	}
+	d := m.Descriptor
+	attrs := []xattr{
+		{"name", m.FullName},
+		{"number", strconv.Itoa(int(d.GetNumber()))},
+		{"type", strings.ToLower(strings.TrimPrefix(d.GetType().String(), "TYPE_"))},
+		{"label", strings.ToLower(strings.TrimPrefix(d.GetLabel().String(), "LABEL_"))},
+	}
+	if d.TypeName != nil {
+		attrs = append(attrs, xattr{"type_name", strings.TrimPrefix(d.GetTypeName(), ".")})
+	}
+	// protoc records the json_name option, or the name it derives
+	jsonName := d.GetJsonName()
+	if jsonName == "" {
+		jsonName = JSONName(d.GetName())
+	}
+	attrs = append(attrs, xattr{"json_name", jsonName})
+	if m.Oneof != "" {
+		attrs = append(attrs, xattr{"oneof", m.Oneof})
+	}
+	if d.DefaultValue != nil {
+		attrs = append(attrs, xattr{"default", d.GetDefaultValue()})
+	}
+	if m.Comments != "" {
+		attrs = append(attrs, xattr{"comment", m.Comments})
+	}
+	return attrs
+}
+
+// Answers a request for the extended attribute req.Name of a node
+// decoded from the field described by m.
+func getxattr(m *FieldMeta, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	for _, attr := range m.xattrs() {
+		if xattrPrefix+attr.name == req.Name {
+			resp.Xattr = []byte(attr.value)
+			return nil
+		}
+	}
+	return fuse.ErrNoXattr
+}
+
+// Answers a request for the names of the extended attributes of a node
+// decoded from the field described by m.
+func listxattr(m *FieldMeta, resp *fuse.ListxattrResponse) error {
+	for _, attr := range m.xattrs() {
+		resp.Append(xattrPrefix + attr.name)
+	}
+	return nil
+}
+
+func (dir *Dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	return getxattr(dir.Meta, req, resp)
+}
+
+func (dir *Dir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	return listxattr(dir.Meta, resp)
+}
+
+func (file *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	return getxattr(file.Meta, req, resp)
+}
+
+func (file *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	return listxattr(file.Meta, resp)
+}
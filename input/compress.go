@@ -0,0 +1,142 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+// Compression is a compression format of the input, detected by the magic
+// bytes at its start.
+type Compression int
+
+const (
+	Uncompressed Compression = iota
+	Gzip
+	Zstd
+	Snappy
+	LZ4
+)
+
+var compressionNames = []string{"none", "gzip", "zstd", "snappy", "lz4"}
+
+func (c Compression) String() string {
+	return compressionNames[c]
+}
+
+// Magic bytes of the compression formats. Snappy is recognised by the
+// stream identifier of its framing format.
+var magic = map[Compression][]byte{
+	Gzip:   {0x1f, 0x8b},
+	Zstd:   {0x28, 0xb5, 0x2f, 0xfd},
+	Snappy: {0xff, 0x06, 0x00, 0x00, 's', 'N', 'a', 'P', 'p', 'Y'},
+	LZ4:    {0x04, 0x22, 0x4d, 0x18},
+}
+
+// Reader reads an input, decompressing it on the fly if it is compressed,
+// and counts the bytes read before and after decompression.
+type Reader struct {
+	Compression Compression
+	compressed  countingReader
+	r           countingReader
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// NewReader detects the compression of r and returns a Reader of its
+// decompressed contents.
+func NewReader(r io.Reader) (*Reader, error) {
+	in := &Reader{compressed: countingReader{r: r}}
+	br := bufio.NewReader(&in.compressed)
+	head, _ := br.Peek(len(magic[Snappy]))
+	for c, m := range magic {
+		if bytes.HasPrefix(head, m) {
+			in.Compression = c
+		}
+	}
+
+	var err error
+	var d io.Reader = br
+	switch in.Compression {
+	case Gzip:
+		d, err = gzip.NewReader(br)
+	case Zstd:
+		var z *zstd.Decoder
+		z, err = zstd.NewReader(br)
+		d = z
+	case Snappy:
+		d = snappy.NewReader(br)
+	case LZ4:
+		d = lz4.NewReader(br)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s input: %v", in.Compression, err)
+	}
+	in.r = countingReader{r: d}
+	return in, nil
+}
+
+// Decompress gets the contents of p, decompressing them if p is
+// compressed.
+func Decompress(p []byte) ([]byte, error) {
+	in, err := NewReader(bytes.NewReader(p))
+	if err != nil {
+		return nil, err
+	}
+	if in.Compression == Uncompressed {
+		return p, nil
+	}
+	d, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, fmt.Errorf("%s input: %v", in.Compression, err)
+	}
+	return d, nil
+}
+
+func (in *Reader) Read(p []byte) (int, error) {
+	return in.r.Read(p)
+}
+
+// Info describes the input read so far: its compression, its size before
+// and after decompression and the compression ratio.
+func (in *Reader) Info() string {
+	if in.Compression == Uncompressed {
+		return fmt.Sprintf("compression: none\nsize: %d\n", in.r.n)
+	}
+	ratio := 0.0
+	if in.compressed.n > 0 {
+		ratio = float64(in.r.n) / float64(in.compressed.n)
+	}
+	return fmt.Sprintf("compression: %s\ncompressed size: %d\nsize: %d\nratio: %.2f\n",
+		in.Compression, in.compressed.n, in.r.n, ratio)
+}
@@ -0,0 +1,79 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package input
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"unicode"
+)
+
+// Removes all whitespace, so that wrapped encodings can be decoded.
+func stripSpace(p []byte) []byte {
+	return bytes.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, p)
+}
+
+// Decodes hex, ignoring whitespace and an optional 0x prefix.
+func decodeHex(p []byte) ([]byte, error) {
+	s := stripSpace(p)
+	if bytes.HasPrefix(s, []byte("0x")) || bytes.HasPrefix(s, []byte("0X")) {
+		s = s[2:]
+	}
+	m := make([]byte, hex.DecodedLen(len(s)))
+	_, err := hex.Decode(m, s)
+	return m, err
+}
+
+// Decodes standard or URL-safe base64, with or without padding, ignoring
+// whitespace.
+func decodeBase64(p []byte) ([]byte, error) {
+	s := string(bytes.TrimRight(stripSpace(p), "="))
+	if bytes.ContainsAny([]byte(s), "-_") {
+		return base64.RawURLEncoding.DecodeString(s)
+	}
+	return base64.RawStdEncoding.DecodeString(s)
+}
+
+// Splits p into its lines, leaving out blank lines.
+func splitLines(p []byte) [][]byte {
+	var lines [][]byte
+	for _, line := range bytes.Split(p, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Decodes one base64 message from each line of p.
+func decodeBase64Lines(p []byte) ([][]byte, error) {
+	var ms [][]byte
+	for i, line := range splitLines(p) {
+		m, err := decodeBase64(line)
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %v", i+1, err)
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
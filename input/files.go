@@ -0,0 +1,152 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package input
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/elrichgro/protofuse/unmarshal"
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+)
+
+// IsFileSet reports whether path names several input files: a directory or
+// a glob pattern that is not itself the name of a file.
+func IsFileSet(path string) bool {
+	if fi, err := os.Stat(path); err == nil {
+		return fi.IsDir()
+	}
+	return strings.ContainsAny(path, "*?[")
+}
+
+// ReadFiles reads the files in the directory, or matching the glob pattern,
+// path, decoding each from format f. The entries are named after the files;
+// a file holding several messages, such as a TFRecord file, gives entries
+// named file.Record_N. types maps file names, or glob patterns matching
+// them, to the fully qualified message types of the files, for files that
+// do not hold messages of type messageName in package packageName. A file
+// that cannot be read or decoded is shown as an error rather than failing.
+func ReadFiles(path string, f Format, types map[string]string, fDesc *google_protobuf.FileDescriptorSet, packageName string, messageName string) ([]unmarshal.Entry, error) {
+	files, err := listFiles(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []unmarshal.Entry
+	for _, file := range files {
+		name := filepath.Base(file)
+		typeName := fileType(types, name)
+		pkg, msg := packageName, messageName
+		if typeName != "" {
+			pkg, msg = "", typeName
+			if i := strings.LastIndex(typeName, "."); i >= 0 {
+				pkg, msg = typeName[:i], typeName[i+1:]
+			}
+		}
+
+		fileEntries, err := readFile(file, f, fDesc, pkg, msg)
+		if err != nil {
+			entries = append(entries, unmarshal.Entry{Name: name, Err: err})
+			continue
+		}
+		for _, entry := range fileEntries {
+			if len(fileEntries) == 1 {
+				entry.Name = name
+			} else {
+				entry.Name = name + "." + entry.Name
+			}
+			entry.Message = typeName
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// Lists the regular files in the directory, or matching the glob pattern,
+// path, leaving out hidden files.
+func listFiles(path string) ([]string, error) {
+	var candidates []string
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		infos, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			candidates = append(candidates, filepath.Join(path, info.Name()))
+		}
+	} else {
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(matches)
+		candidates = matches
+	}
+
+	var files []string
+	for _, file := range candidates {
+		if strings.HasPrefix(filepath.Base(file), ".") {
+			continue
+		}
+		if fi, err := os.Stat(file); err == nil && fi.Mode().IsRegular() {
+			files = append(files, file)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("No input files in %s", path)
+	}
+	return files, nil
+}
+
+// Gets the message type of the file called name from types, preferring an
+// exact match over the first matching pattern in sorted order.
+func fileType(types map[string]string, name string) string {
+	if typeName, ok := types[name]; ok {
+		return strings.TrimPrefix(typeName, ".")
+	}
+	patterns := make([]string, 0, len(types))
+	for pattern := range types {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return strings.TrimPrefix(types[pattern], ".")
+		}
+	}
+	return ""
+}
+
+// Reads and decodes the input file, decompressing it if needed.
+func readFile(file string, f Format, fDesc *google_protobuf.FileDescriptorSet, packageName string, messageName string) ([]unmarshal.Entry, error) {
+	r, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	in, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	p, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	return Decode(p, f, fDesc, packageName, messageName)
+}
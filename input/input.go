@@ -0,0 +1,152 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+// Package input converts the encodings protofuse accepts for its input
+// into the wire format that is unmarshalled into the tree.
+package input
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/elrichgro/protofuse/marshal"
+	"github.com/elrichgro/protofuse/unmarshal"
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+)
+
+// Format is an encoding of an input message.
+type Format int
+
+const (
+	Auto Format = iota
+	Binary
+	Text
+	JSON
+	Hex
+	Base64
+	// one base64 encoded message on each line
+	Base64Lines
+	TFRecord
+	// records preceded by their length as a varint
+	RecordIO
+)
+
+var formatNames = []string{"auto", "binary", "text", "json", "hex", "base64", "base64-lines", "tfrecord", "recordio"}
+
+// ParseFormat gets the format called s.
+func ParseFormat(s string) (Format, error) {
+	for i, name := range formatNames {
+		if s == name {
+			return Format(i), nil
+		}
+	}
+	return Auto, fmt.Errorf("Unknown input format: %s", s)
+}
+
+func (f Format) String() string {
+	return formatNames[f]
+}
+
+// Detect guesses the format of p, holding messages of type messageName in
+// package packageName: JSON if it is a JSON object, TFRecord if it starts
+// with a valid record header, binary if it is a marshaled message of the
+// type, hex or base64 if it is made up of those characters and decodes to
+// one, and text if it is valid UTF-8. Without a schema any valid wire format
+// counts as a marshaled message. RecordIO cannot be told apart from the wire
+// format and is never detected.
+func Detect(p []byte, fDesc *google_protobuf.FileDescriptorSet, packageName string, messageName string) Format {
+	isMessage := func(m []byte) bool {
+		if fDesc == nil {
+			return unmarshal.IsWireFormat(m)
+		}
+		return unmarshal.MatchesSchema(fDesc, packageName, messageName, m)
+	}
+	trimmed := bytes.TrimSpace(p)
+	if len(trimmed) > 0 && trimmed[0] == '{' && json.Valid(trimmed) {
+		return JSON
+	}
+	if isTFRecord(p) {
+		return TFRecord
+	}
+	if isMessage(p) {
+		return Binary
+	}
+	if len(trimmed) > 0 {
+		if m, err := decodeHex(trimmed); err == nil && isMessage(m) {
+			return Hex
+		}
+		if lines := splitLines(trimmed); len(lines) > 1 {
+			if ms, err := decodeBase64Lines(trimmed); err == nil && all(ms, isMessage) {
+				return Base64Lines
+			}
+		}
+		if m, err := decodeBase64(trimmed); err == nil && isMessage(m) {
+			return Base64
+		}
+	}
+	if utf8.Valid(p) {
+		return Text
+	}
+	return Binary
+}
+
+func all(ms [][]byte, f func([]byte) bool) bool {
+	for _, m := range ms {
+		if !f(m) {
+			return false
+		}
+	}
+	return true
+}
+
+// Decode converts the input p holding messages of type messageName in
+// package packageName from format f to the wire format, detecting the
+// format if f is Auto. Base64Lines and the record formats hold a list of
+// messages, the other formats a single message.
+func Decode(p []byte, f Format, fDesc *google_protobuf.FileDescriptorSet, packageName string, messageName string) ([]unmarshal.Entry, error) {
+	if f == Auto {
+		f = Detect(p, fDesc, packageName, messageName)
+	}
+	var m []byte
+	var err error
+	switch f {
+	case Text:
+		m, err = marshal.Text(fDesc, packageName, messageName, p)
+	case JSON:
+		m, err = marshal.JSON(fDesc, packageName, messageName, p)
+	case Hex:
+		m, err = decodeHex(p)
+	case Base64:
+		m, err = decodeBase64(p)
+	case Base64Lines:
+		var ms [][]byte
+		ms, err = decodeBase64Lines(p)
+		if err != nil {
+			return nil, fmt.Errorf("%s input: %v", f, err)
+		}
+		return unmarshal.MessageEntries(ms), nil
+	case TFRecord:
+		return readTFRecords(p), nil
+	case RecordIO:
+		return readDelimited(p), nil
+	default:
+		m = p
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s input: %v", f, err)
+	}
+	return unmarshal.MessageEntries([][]byte{m}), nil
+}
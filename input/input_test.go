@@ -0,0 +1,312 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package input
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/elrichgro/protofuse/test"
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestNewReader(t *testing.T) {
+	buf, _, _, _, err := test.GenerateFull()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	w.Write(buf)
+	w.Close()
+
+	for _, c := range []struct {
+		input       []byte
+		compression Compression
+	}{
+		{buf, Uncompressed},
+		{compressed.Bytes(), Gzip},
+	} {
+		in, err := NewReader(bytes.NewReader(c.input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := ioutil.ReadAll(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if in.Compression != c.compression {
+			t.Error(fmt.Sprintf("Detected compression %v, expected %v", in.Compression, c.compression))
+		}
+		if !bytes.Equal(p, buf) {
+			t.Error(fmt.Sprintf("Read %x from %v input, expected %x", p, c.compression, buf))
+		}
+		if p, err := Decompress(c.input); err != nil || !bytes.Equal(p, buf) {
+			t.Error(fmt.Sprintf("Decompressed %x, %v from %v input, expected %x", p, err, c.compression, buf))
+		}
+	}
+}
+
+func TestDetect(t *testing.T) {
+	buf, fDesc, packageName, messageName, err := test.GenerateFull()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.StdEncoding.EncodeToString(buf)
+	url := base64.RawURLEncoding.EncodeToString(buf)
+
+	for _, c := range []struct {
+		input  string
+		format Format
+		count  int
+	}{
+		{string(buf), Binary, 1},
+		{hex.EncodeToString(buf) + "\n", Hex, 1},
+		{b64 + "\n", Base64, 1},
+		{url, Base64, 1},
+		{b64 + "\n" + url + "\n\n" + b64 + "\n", Base64Lines, 3},
+	} {
+		if f := Detect([]byte(c.input), fDesc, packageName, messageName); f != c.format {
+			t.Error(fmt.Sprintf("Detected %v for %q, expected %v", f, c.input, c.format))
+			continue
+		}
+		ms, err := Decode([]byte(c.input), c.format, nil, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ms) != c.count {
+			t.Error(fmt.Sprintf("Decoded %d messages from %v input, expected %d", len(ms), c.format, c.count))
+		}
+		for _, m := range ms {
+			if !bytes.Equal(m.Data, buf) {
+				t.Error(fmt.Sprintf("Decoded %x from %v input, expected %x", m.Data, c.format, buf))
+			}
+		}
+	}
+}
+
+// The message of test.GenerateFull written by hand in the text format and
+// the JSON mapping.
+const (
+	fullText = `# a fixture as it would be kept in a .textproto file
+f1: "one"
+f2: [1, 2, 3, 4]
+f3: 3
+f4: 4
+f5: 5
+f6: 6
+f7: true
+f8: 8
+f9: 9
+f10: 10.0
+f11: "\013\013"
+f12 {
+  id: 123
+  [test.name]: "BAR"
+}
+f13: 13
+f14: 14
+f15: 15.0
+f16 { f1: "name" f2: e1 f3 { name: "name" } }
+f16 { f1: "name2" f2: e2 f3 { name: "name2" } }
+[test.f121]: 123
+`
+	fullJSON = `{
+  "f1": "one",
+  "f2": [1, 2, 3, 4],
+  "f3": "3",
+  "f4": 4,
+  "f5": "5",
+  "f6": 6,
+  "f7": true,
+  "f8": "8",
+  "f9": "9",
+  "f10": 10,
+  "f11": "Cws=",
+  "f12": {"id": 123, "[test.name]": "BAR"},
+  "f13": 13,
+  "f14": 14,
+  "f15": 15,
+  "f16": [
+    {"f1": "name", "f2": "e1", "f3": {"name": "name"}},
+    {"f1": "name2", "f2": "e2", "f3": {"name": "name2"}}
+  ],
+  "[test.f121]": 123
+}
+`
+)
+
+func TestDecodeTextAndJSON(t *testing.T) {
+	buf, fDesc, packageName, messageName, err := test.GenerateFull()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		input  string
+		format Format
+	}{
+		{fullText, Text},
+		{fullJSON, JSON},
+	} {
+		if f := Detect([]byte(c.input), fDesc, packageName, messageName); f != c.format {
+			t.Error(fmt.Sprintf("Detected %v, expected %v", f, c.format))
+		}
+		entries, err := Decode([]byte(c.input), Auto, fDesc, packageName, messageName)
+		if err != nil {
+			t.Fatal(fmt.Sprintf("%v input: %v", c.format, err))
+		}
+		if len(entries) != 1 {
+			t.Fatal(fmt.Sprintf("Decoded %d messages from %v input, expected 1", len(entries), c.format))
+		}
+		// extensions may be marshaled in a different order
+		var got, expected test.Foo
+		if err := proto.Unmarshal(entries[0].Data, &got); err != nil {
+			t.Fatal(err)
+		}
+		if err := proto.Unmarshal(buf, &expected); err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(&got, &expected) {
+			t.Error(fmt.Sprintf("Decoded %v from %v input, expected %v", &got, c.format, &expected))
+		}
+	}
+
+	// text that is also valid wire format, but not of the type
+	p := []byte("p1p2")
+	if f := Detect(p, nil, "", ""); f != Binary {
+		t.Error(fmt.Sprintf("Detected %v for %q without a schema, expected %v", f, p, Binary))
+	}
+	if f := Detect(p, fDesc, packageName, messageName); f != Text {
+		t.Error(fmt.Sprintf("Detected %v for %q, expected %v", f, p, Text))
+	}
+}
+
+// Frames p as a TFRecord.
+func tfRecord(p []byte) []byte {
+	header := make([]byte, 12)
+	binary.LittleEndian.PutUint64(header, uint64(len(p)))
+	binary.LittleEndian.PutUint32(header[8:], maskedCRC(header[:8]))
+	footer := make([]byte, 4)
+	binary.LittleEndian.PutUint32(footer, maskedCRC(p))
+	return append(append(header, p...), footer...)
+}
+
+func TestTFRecord(t *testing.T) {
+	buf, _, _, _, err := test.GenerateFull()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt := tfRecord(buf)
+	corrupt[len(corrupt)-1] ^= 0xff
+	p := append(append(tfRecord(buf), corrupt...), tfRecord(buf)...)
+
+	if f := Detect(p, nil, "", ""); f != TFRecord {
+		t.Error(fmt.Sprintf("Detected %v, expected %v", f, TFRecord))
+	}
+	entries, err := Decode(p, TFRecord, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatal(fmt.Sprintf("Read %d records, expected 3", len(entries)))
+	}
+	for i, entry := range entries {
+		if entry.Name != fmt.Sprintf("Record_%d", i+1) {
+			t.Error(fmt.Sprintf("Record %d is called %s", i+1, entry.Name))
+		}
+		if !bytes.Equal(entry.Data, buf) {
+			t.Error(fmt.Sprintf("Record %d holds %x, expected %x", i+1, entry.Data, buf))
+		}
+		if (entry.Err != nil) != (i == 1) {
+			t.Error(fmt.Sprintf("Record %d has error %v", i+1, entry.Err))
+		}
+	}
+}
+
+func TestTFRecordOversized(t *testing.T) {
+	// A length near the top of the uint64 range must not wrap around when
+	// the footer is added to it.
+	p := make([]byte, 20)
+	binary.LittleEndian.PutUint64(p, ^uint64(0)-2)
+	binary.LittleEndian.PutUint32(p[8:], maskedCRC(p[:8]))
+
+	if f := Detect(p, nil, "", ""); f != TFRecord {
+		t.Error(fmt.Sprintf("Detected %v, expected %v", f, TFRecord))
+	}
+	entries, err := Decode(p, TFRecord, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Err == nil {
+		t.Error(fmt.Sprintf("Read %v, expected a single framing error", entries))
+	}
+}
+
+func TestReadFiles(t *testing.T) {
+	buf, fDesc, packageName, messageName, err := test.GenerateFull()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "protofuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string][]byte{
+		"a.pb":    buf,
+		"b.hex":   []byte(hex.EncodeToString(buf)),
+		".hidden": buf,
+	}
+	for name, p := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), p, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	types := map[string]string{"*.hex": packageName + "." + messageName}
+
+	for _, path := range []string{dir, filepath.Join(dir, "*")} {
+		if !IsFileSet(path) {
+			t.Error(fmt.Sprintf("%s is not a file set", path))
+		}
+		entries, err := ReadFiles(path, Auto, types, fDesc, packageName, messageName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 || entries[0].Name != "a.pb" || entries[1].Name != "b.hex" {
+			t.Fatal(fmt.Sprintf("Read entries %v, expected a.pb and b.hex", entries))
+		}
+		if entries[0].Message != "" || entries[1].Message != packageName+"."+messageName {
+			t.Error(fmt.Sprintf("Entries have types %s and %s", entries[0].Message, entries[1].Message))
+		}
+		for _, entry := range entries {
+			if !bytes.Equal(entry.Data, buf) {
+				t.Error(fmt.Sprintf("%s holds %x, expected %x", entry.Name, entry.Data, buf))
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package input
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/elrichgro/protofuse/unmarshal"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Computes the masked CRC32C that TFRecord files store for lengths and data.
+func maskedCRC(p []byte) uint32 {
+	crc := crc32.Checksum(p, castagnoli)
+	return (crc>>15 | crc<<17) + 0xa282ead8
+}
+
+// Reports whether p starts with a TFRecord header whose length checksum
+// is valid.
+func isTFRecord(p []byte) bool {
+	return len(p) >= 12 && maskedCRC(p[:8]) == binary.LittleEndian.Uint32(p[8:12])
+}
+
+func recordName(i int) string {
+	return fmt.Sprintf("Record_%d", i+1)
+}
+
+// Splits a TFRecord file into its records, which are framed as
+//
+//	uint64 length
+//	uint32 masked CRC32C of length
+//	byte   data[length]
+//	uint32 masked CRC32C of data
+//
+// A record whose data fails its checksum is kept with the failure as its
+// error. A corrupt length or a truncated record ends the file, as the
+// records after it cannot be found.
+func readTFRecords(p []byte) []unmarshal.Entry {
+	var entries []unmarshal.Entry
+	for i := 0; len(p) > 0; i++ {
+		entry := unmarshal.Entry{Name: recordName(i)}
+		if len(p) < 12 {
+			entry.Err = fmt.Errorf("Truncated record header")
+			return append(entries, entry)
+		}
+		if maskedCRC(p[:8]) != binary.LittleEndian.Uint32(p[8:12]) {
+			entry.Err = fmt.Errorf("Length checksum mismatch, the remaining records are skipped")
+			return append(entries, entry)
+		}
+		length := binary.LittleEndian.Uint64(p[:8])
+		if len(p) < 16 || length > uint64(len(p)-16) {
+			entry.Err = fmt.Errorf("Truncated record: %d bytes of data expected, %d remain", length, len(p)-12)
+			return append(entries, entry)
+		}
+		entry.Data = p[12 : 12+length]
+		crc := binary.LittleEndian.Uint32(p[12+length : 16+length])
+		if maskedCRC(entry.Data) != crc {
+			entry.Err = fmt.Errorf("Data checksum mismatch")
+		}
+		entries = append(entries, entry)
+		p = p[16+length:]
+	}
+	return entries
+}
+
+// Splits a simple RecordIO file, in which each record is preceded by its
+// length as a varint, as written by writeDelimitedTo. The format has no
+// checksums, so only a truncated record can be reported.
+func readDelimited(p []byte) []unmarshal.Entry {
+	var entries []unmarshal.Entry
+	for i := 0; len(p) > 0; i++ {
+		entry := unmarshal.Entry{Name: recordName(i)}
+		length, n := binary.Uvarint(p)
+		if n <= 0 {
+			entry.Err = fmt.Errorf("Invalid record length")
+			return append(entries, entry)
+		}
+		p = p[n:]
+		if uint64(len(p)) < length {
+			entry.Err = fmt.Errorf("Truncated record: %d bytes of data expected, %d remain", length, len(p))
+			return append(entries, entry)
+		}
+		entry.Data = p[:length]
+		entries = append(entries, entry)
+		p = p[length:]
+	}
+	return entries
+}
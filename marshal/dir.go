@@ -0,0 +1,274 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package marshal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/elrichgro/protofuse/fuse"
+	"github.com/elrichgro/protofuse/unmarshal"
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+)
+
+// Directory encodes the message of type messageName in package packageName
+// that is laid out in the directory path, as shown by the mount or written
+// by protofuse extract. opts must be the options the directory was produced
+// with, so that bytes fields and embedded messages can be read back.
+func Directory(fDesc *google_protobuf.FileDescriptorSet, packageName string, messageName string, path string, opts unmarshal.Options) ([]byte, error) {
+	enc := newEncoder(fDesc)
+	enc.options = opts
+	enc.decoder = unmarshal.NewDecoder(fDesc, opts)
+	m, err := enc.newMessage(qualify(packageName, messageName))
+	if err != nil {
+		return nil, err
+	}
+	err = readDir(m, path)
+	if err != nil {
+		return nil, err
+	}
+	return m.marshal()
+}
+
+func qualify(packageName string, messageName string) string {
+	if packageName == "" {
+		return "." + messageName
+	}
+	return "." + packageName + "." + messageName
+}
+
+// Adds the fields laid out in the directory path to m.
+func readDir(m *message, path string) error {
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		name := fi.Name()
+		if m.enc.options.Naming.Extensions && !fi.IsDir() {
+			name, _ = unmarshal.TrimTypeExtension(name)
+		}
+		// exports, @type and alternate views of bytes fields; field names
+		// never contain dots
+		if strings.Contains(name, ".") || name == "@type" {
+			continue
+		}
+		field, index := m.resolve(name)
+		if field == nil {
+			return fmt.Errorf("%s: no field %s in %s", path, name, m.typeName[1:])
+		}
+		if fi.IsDir() && name == field.GetName() && m.isList(field) {
+			err = readList(m, field, filepath.Join(path, name))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		v, err := readField(m, field, filepath.Join(path, fi.Name()), fi)
+		if err != nil {
+			return err
+		}
+		v.index = index
+		m.add(v)
+	}
+	return nil
+}
+
+// Reports whether the repeated field of m is shown as a directory of its
+// elements under the naming m.enc.options.
+func (m *message) isList(field *google_protobuf.FieldDescriptorProto) bool {
+	if field.GetLabel() != google_protobuf.FieldDescriptorProto_LABEL_REPEATED {
+		return false
+	}
+	_, keyed := m.enc.options.Naming.Keys[m.fieldName(field)]
+	return m.enc.options.Naming.Subdirs || keyed
+}
+
+// Adds the elements of the repeated field in the list directory path to m,
+// in the order they are listed. Elements may be named by index or by key.
+func readList(m *message, field *google_protobuf.FieldDescriptorProto, path string) error {
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for _, fi := range entries {
+		names[fi.Name()] = true
+		if m.enc.options.Naming.Extensions && !fi.IsDir() {
+			name, _ := unmarshal.TrimTypeExtension(fi.Name())
+			names[name] = true
+		}
+	}
+	index := 0
+	for _, fi := range entries {
+		// with type extensions, elements carry one and views do not
+		_, ext := unmarshal.TrimTypeExtension(fi.Name())
+		element := m.enc.options.Naming.Extensions && !fi.IsDir() && ext != ""
+		if !element && isView(fi.Name(), names) {
+			continue
+		}
+		v, err := readField(m, field, filepath.Join(path, fi.Name()), fi)
+		if err != nil {
+			return err
+		}
+		v.index = index
+		index++
+		m.add(v)
+	}
+	return nil
+}
+
+// Reports whether name is an alternate view of one of names.
+func isView(name string, names map[string]bool) bool {
+	for _, format := range []unmarshal.BytesFormat{unmarshal.BytesHex, unmarshal.BytesBase64, unmarshal.BytesHexdump, unmarshal.BytesRaw, unmarshal.BytesAuto} {
+		ext := format.Extension()
+		if strings.HasSuffix(name, ext) && names[strings.TrimSuffix(name, ext)] {
+			return true
+		}
+	}
+	return false
+}
+
+// Finds the field shown as name, along with the index of the element of a
+// repeated field shown as field_N.
+func (m *message) resolve(name string) (*google_protobuf.FieldDescriptorProto, int) {
+	if field := m.findField(name); field != nil {
+		return field, 0
+	}
+	i := strings.LastIndex(name, "_")
+	if i < 0 {
+		return nil, 0
+	}
+	index, err := strconv.Atoi(name[i+1:])
+	if err != nil {
+		return nil, 0
+	}
+	field := m.findField(name[:i])
+	if field == nil || field.GetLabel() != google_protobuf.FieldDescriptorProto_LABEL_REPEATED {
+		return nil, 0
+	}
+	return field, index
+}
+
+// Reads the value of field of m from the file or directory at path.
+func readField(m *message, field *google_protobuf.FieldDescriptorProto, path string, fi os.FileInfo) (fieldValue, error) {
+	v := fieldValue{field: field}
+	if fi.IsDir() {
+		typeName := field.GetTypeName()
+		if field.GetType() == google_protobuf.FieldDescriptorProto_TYPE_BYTES {
+			embedded, ok := m.enc.options.Embedded[m.fieldName(field)]
+			if !ok {
+				return v, fmt.Errorf("%s: bytes field %s is not an embedded message", path, field.GetName())
+			}
+			typeName = embedded
+		} else if field.GetType() != google_protobuf.FieldDescriptorProto_TYPE_MESSAGE {
+			return v, fmt.Errorf("%s: field %s is not a message", path, field.GetName())
+		}
+		if typeName == ".google.protobuf.Any" {
+			if _, err := os.Stat(filepath.Join(path, "@type")); err == nil {
+				p, err := m.enc.readAny(path)
+				v.bytes = p
+				return v, err
+			}
+		}
+		nested, err := m.enc.newMessage(typeName)
+		if err != nil {
+			return v, err
+		}
+		v.message = nested
+		return v, readDir(nested, path)
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return v, err
+	}
+	// views are named after the field without its type extension
+	base, ext := path, ""
+	if m.enc.options.Naming.Extensions {
+		base, ext = unmarshal.TrimTypeExtension(path)
+	}
+	// a string could hold the word, but a redacted field always does
+	if m.enc.decoder.IsRedacted(field) || string(contents) == pfuse.Redacted && field.GetType() != google_protobuf.FieldDescriptorProto_TYPE_STRING {
+		return v, fmt.Errorf("%s: field %s is redacted", path, field.GetName())
+	}
+	if m.enc.decoder.IsRounded(field) {
+		return v, fmt.Errorf("%s: field %s is rounded by its format option", path, field.GetName())
+	}
+	switch field.GetType() {
+	case google_protobuf.FieldDescriptorProto_TYPE_MESSAGE:
+		if !isWellKnown(field.GetTypeName()) {
+			return v, fmt.Errorf("%s: field %s is a message", path, field.GetName())
+		}
+		v.bytes, err = encodeWellKnown(field.GetTypeName(), string(contents))
+	case google_protobuf.FieldDescriptorProto_TYPE_BYTES:
+		// a .bin file and the raw view, if there is one, hold the bytes
+		// unchanged
+		if ext == ".bin" {
+			v.bytes = contents
+			break
+		}
+		if raw, err := ioutil.ReadFile(base + unmarshal.BytesRaw.Extension()); err == nil {
+			v.bytes = raw
+			break
+		}
+		v.bytes, err = unmarshal.ParseBytes(string(contents), m.enc.decoder.FieldBytesFormat(field))
+	default:
+		v.text = string(contents)
+	}
+	if err != nil {
+		return v, fmt.Errorf("%s: %v", path, err)
+	}
+	return v, nil
+}
+
+// Encodes the expanded google.protobuf.Any in the directory path.
+func (enc *encoder) readAny(path string) ([]byte, error) {
+	typeURL, err := ioutil.ReadFile(filepath.Join(path, "@type"))
+	if err != nil {
+		return nil, err
+	}
+	url := strings.TrimSpace(string(typeURL))
+	typeName := "." + url[strings.LastIndex(url, "/")+1:]
+
+	var value []byte
+	if isWellKnown(typeName) {
+		contents, err := ioutil.ReadFile(filepath.Join(path, "value"))
+		if err != nil {
+			return nil, err
+		}
+		value, err = encodeWellKnown(typeName, string(contents))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		packed, err := enc.newMessage(typeName)
+		if err != nil {
+			return nil, err
+		}
+		if err := readDir(packed, path); err != nil {
+			return nil, err
+		}
+		value, err = packed.marshal()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return appendBytes(appendBytes(nil, 1, []byte(url)), 2, value), nil
+}
@@ -0,0 +1,242 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package marshal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/elrichgro/protofuse/fuse"
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+)
+
+// JSON encodes the message of type messageName in package packageName given
+// in the proto3 JSON mapping.
+func JSON(fDesc *google_protobuf.FileDescriptorSet, packageName string, messageName string, data []byte) ([]byte, error) {
+	enc := newEncoder(fDesc)
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return enc.jsonMessage(qualify(packageName, messageName), v)
+}
+
+// Encodes the JSON value v of a message of type typeName.
+func (enc *encoder) jsonMessage(typeName string, v interface{}) ([]byte, error) {
+	if isWellKnown(typeName) {
+		return encodeWellKnown(typeName, wellKnownText(typeName, v))
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: expected a JSON object", typeName[1:])
+	}
+	if typeName == ".google.protobuf.Any" {
+		return enc.jsonAny(obj)
+	}
+	m, err := enc.newMessage(typeName)
+	if err != nil {
+		return nil, err
+	}
+	err = readJSON(m, obj)
+	if err != nil {
+		return nil, err
+	}
+	return m.marshal()
+}
+
+// Gets the form of the JSON value v understood by encodeWellKnown.
+func wellKnownText(typeName string, v interface{}) string {
+	switch typeName {
+	case ".google.protobuf.Struct", ".google.protobuf.Value", ".google.protobuf.ListValue":
+	default:
+		if s, ok := v.(string); ok {
+			return s
+		}
+	}
+	p, _ := json.Marshal(v)
+	return string(p)
+}
+
+// Encodes a google.protobuf.Any given with an @type member.
+func (enc *encoder) jsonAny(obj map[string]interface{}) ([]byte, error) {
+	url, ok := obj["@type"].(string)
+	if !ok {
+		return nil, fmt.Errorf("google.protobuf.Any: missing @type")
+	}
+	typeName := "." + url[strings.LastIndex(url, "/")+1:]
+
+	var value []byte
+	var err error
+	if isWellKnown(typeName) {
+		value, err = enc.jsonMessage(typeName, obj["value"])
+	} else {
+		packed := make(map[string]interface{})
+		for k, v := range obj {
+			if k != "@type" {
+				packed[k] = v
+			}
+		}
+		value, err = enc.jsonMessage(typeName, packed)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return appendBytes(appendBytes(nil, 1, []byte(url)), 2, value), nil
+}
+
+// Adds the members of obj to m.
+func readJSON(m *message, obj map[string]interface{}) error {
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		field := m.findJSONField(k)
+		if field == nil {
+			return fmt.Errorf("%s: no field %s", m.typeName[1:], k)
+		}
+		v := obj[k]
+		if v == nil {
+			continue
+		}
+		if field.GetLabel() != google_protobuf.FieldDescriptorProto_LABEL_REPEATED {
+			fv, err := m.enc.jsonValue(field, v)
+			if err != nil {
+				return err
+			}
+			m.add(fv)
+			continue
+		}
+
+		if entry, ok := m.enc.messages[field.GetTypeName()]; ok && entry.GetOptions().GetMapEntry() {
+			err := readJSONMap(m, field, entry, v)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		l, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected a JSON array for %s", m.typeName[1:], k)
+		}
+		for i, e := range l {
+			fv, err := m.enc.jsonValue(field, e)
+			if err != nil {
+				return err
+			}
+			fv.index = i
+			m.add(fv)
+		}
+	}
+	return nil
+}
+
+// Adds the entries of the map field given as the JSON object v to m.
+func readJSONMap(m *message, field *google_protobuf.FieldDescriptorProto, entry *google_protobuf.DescriptorProto, v interface{}) error {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s: expected a JSON object for %s", m.typeName[1:], field.GetName())
+	}
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for i, k := range keys {
+		e, err := m.enc.newMessage(field.GetTypeName())
+		if err != nil {
+			return err
+		}
+		for _, f := range entry.GetField() {
+			switch f.GetNumber() {
+			case 1:
+				e.add(fieldValue{field: f, text: k})
+			case 2:
+				fv, err := m.enc.jsonValue(f, obj[k])
+				if err != nil {
+					return err
+				}
+				e.add(fv)
+			}
+		}
+		m.add(fieldValue{field: field, index: i, message: e})
+	}
+	return nil
+}
+
+// Finds the field of m called key in JSON, by its lowerCamelCase name, its
+// original name or, for extensions, its name in brackets.
+func (m *message) findJSONField(key string) *google_protobuf.FieldDescriptorProto {
+	if strings.HasPrefix(key, "[") && strings.HasSuffix(key, "]") {
+		return m.findField(key[1 : len(key)-1])
+	}
+	for _, field := range m.desc.GetField() {
+		if pfuse.JSONName(field.GetName()) == key {
+			return field
+		}
+	}
+	return m.findField(key)
+}
+
+// Converts the JSON value v of field.
+func (enc *encoder) jsonValue(field *google_protobuf.FieldDescriptorProto, v interface{}) (fieldValue, error) {
+	fv := fieldValue{field: field}
+	switch field.GetType() {
+	case google_protobuf.FieldDescriptorProto_TYPE_MESSAGE:
+		p, err := enc.jsonMessage(field.GetTypeName(), v)
+		fv.bytes = p
+		return fv, err
+	case google_protobuf.FieldDescriptorProto_TYPE_GROUP:
+		return fv, fmt.Errorf("Groups are not supported")
+	case google_protobuf.FieldDescriptorProto_TYPE_BYTES:
+		s, ok := v.(string)
+		if !ok {
+			return fv, fmt.Errorf("%s: expected base64 string", field.GetName())
+		}
+		p, err := decodeBase64(s)
+		fv.bytes = p
+		return fv, err
+	}
+	switch v := v.(type) {
+	case string:
+		fv.text = v
+	case json.Number:
+		fv.text = v.String()
+	case bool:
+		fv.text = strconv.FormatBool(v)
+	default:
+		return fv, fmt.Errorf("%s: unexpected JSON value %v", field.GetName(), v)
+	}
+	return fv, nil
+}
+
+// Decodes standard or URL-safe base64, with or without padding.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if strings.ContainsAny(s, "-_") {
+		return base64.RawURLEncoding.DecodeString(s)
+	}
+	return base64.RawStdEncoding.DecodeString(s)
+}
@@ -0,0 +1,376 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+// Package marshal encodes protocol buffers from their presentation in
+// protofuse back into the wire format, using the descriptors of the schema.
+package marshal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/elrichgro/protofuse/unmarshal"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+)
+
+// encoder holds the descriptors of a schema, indexed for the lookups made
+// while encoding, along with the options a directory was produced with. One
+// is made for each call, so that calls for different schemas can run at the
+// same time.
+type encoder struct {
+	// Messages and enums by fully qualified name, with a leading dot.
+	messages map[string]*google_protobuf.DescriptorProto
+	enums    map[string]*google_protobuf.EnumDescriptorProto
+	// Extensions by the fully qualified name of the extended message.
+	extensions map[string][]extension
+	// Options of the directory read by Directory, and the Decoder that
+	// applied them.
+	options unmarshal.Options
+	decoder *unmarshal.Decoder
+}
+
+type extension struct {
+	// fully qualified name, without a leading dot
+	name  string
+	field *google_protobuf.FieldDescriptorProto
+}
+
+// A message to be encoded, built from one of the presentations.
+type message struct {
+	enc      *encoder
+	typeName string
+	desc     *google_protobuf.DescriptorProto
+	fields   []fieldValue
+}
+
+// The value of one field, or of one element of a repeated field. Scalars
+// are given in their textual form, except for bytes which are given as is.
+type fieldValue struct {
+	field *google_protobuf.FieldDescriptorProto
+	// position among the elements of a repeated field
+	index   int
+	text    string
+	bytes   []byte
+	message *message
+	// enum is the type of an enum field, set by add
+	enum *google_protobuf.EnumDescriptorProto
+}
+
+// Makes an encoder for the types of fDesc.
+func newEncoder(fDesc *google_protobuf.FileDescriptorSet) *encoder {
+	enc := &encoder{
+		messages:   make(map[string]*google_protobuf.DescriptorProto),
+		enums:      make(map[string]*google_protobuf.EnumDescriptorProto),
+		extensions: make(map[string][]extension),
+	}
+	for _, file := range fDesc.GetFile() {
+		prefix := "."
+		if file.GetPackage() != "" {
+			prefix += file.GetPackage() + "."
+		}
+		for _, e := range file.GetEnumType() {
+			enc.enums[prefix+e.GetName()] = e
+		}
+		for _, ext := range file.GetExtension() {
+			enc.extensions[ext.GetExtendee()] = append(enc.extensions[ext.GetExtendee()], extension{prefix[1:] + ext.GetName(), ext})
+		}
+		for _, m := range file.GetMessageType() {
+			enc.indexMessage(m, prefix)
+		}
+	}
+	return enc
+}
+
+func (enc *encoder) indexMessage(m *google_protobuf.DescriptorProto, prefix string) {
+	name := prefix + m.GetName()
+	enc.messages[name] = m
+	for _, e := range m.GetEnumType() {
+		enc.enums[name+"."+e.GetName()] = e
+	}
+	for _, ext := range m.GetExtension() {
+		enc.extensions[ext.GetExtendee()] = append(enc.extensions[ext.GetExtendee()], extension{name[1:] + "." + ext.GetName(), ext})
+	}
+	for _, nested := range m.GetNestedType() {
+		enc.indexMessage(nested, name+".")
+	}
+}
+
+// Creates an empty message of the fully qualified type typeName.
+func (enc *encoder) newMessage(typeName string) (*message, error) {
+	if !strings.HasPrefix(typeName, ".") {
+		typeName = "." + typeName
+	}
+	desc, ok := enc.messages[typeName]
+	if !ok {
+		return nil, fmt.Errorf("Cannot find message: %s", typeName)
+	}
+	return &message{enc: enc, typeName: typeName, desc: desc}, nil
+}
+
+// Finds the field or extension of m called name. Extensions may be named by
+// their fully qualified name or by their name alone.
+func (m *message) findField(name string) *google_protobuf.FieldDescriptorProto {
+	for _, field := range m.desc.GetField() {
+		if field.GetName() == name {
+			return field
+		}
+	}
+	for _, ext := range m.enc.extensions[m.typeName] {
+		if ext.name == name || ext.field.GetName() == name {
+			return ext.field
+		}
+	}
+	return nil
+}
+
+// Gets the fully qualified name of a field of m, without a leading dot.
+func (m *message) fieldName(field *google_protobuf.FieldDescriptorProto) string {
+	for _, ext := range m.enc.extensions[m.typeName] {
+		if ext.field == field {
+			return ext.name
+		}
+	}
+	return m.typeName[1:] + "." + field.GetName()
+}
+
+func (m *message) add(v fieldValue) {
+	if v.field.GetType() == google_protobuf.FieldDescriptorProto_TYPE_ENUM {
+		v.enum = m.enc.enums[v.field.GetTypeName()]
+	}
+	m.fields = append(m.fields, v)
+}
+
+// Encodes m in the wire format, with fields in field number order and the
+// elements of repeated fields in index order.
+func (m *message) marshal() ([]byte, error) {
+	fields := make([]fieldValue, len(m.fields))
+	copy(fields, m.fields)
+	sort.SliceStable(fields, func(i, j int) bool {
+		if fields[i].field.GetNumber() != fields[j].field.GetNumber() {
+			return fields[i].field.GetNumber() < fields[j].field.GetNumber()
+		}
+		return fields[i].index < fields[j].index
+	})
+
+	var buf []byte
+	for i := 0; i < len(fields); {
+		field := fields[i].field
+		j := i
+		for j < len(fields) && fields[j].field == field {
+			j++
+		}
+		if field.GetOptions().GetPacked() {
+			var packed []byte
+			for _, v := range fields[i:j] {
+				p, err := encodeScalar(v)
+				if err != nil {
+					return nil, err
+				}
+				packed = append(packed, p...)
+			}
+			buf = appendKey(buf, field.GetNumber(), 2)
+			buf = append(buf, proto.EncodeVarint(uint64(len(packed)))...)
+			buf = append(buf, packed...)
+		} else {
+			for _, v := range fields[i:j] {
+				p, err := v.encode()
+				if err != nil {
+					return nil, err
+				}
+				buf = append(buf, p...)
+			}
+		}
+		i = j
+	}
+	return buf, nil
+}
+
+// Encodes the key and value of v.
+func (v fieldValue) encode() ([]byte, error) {
+	field := v.field
+	switch field.GetType() {
+	case google_protobuf.FieldDescriptorProto_TYPE_MESSAGE, google_protobuf.FieldDescriptorProto_TYPE_BYTES,
+		google_protobuf.FieldDescriptorProto_TYPE_STRING:
+		var p []byte
+		switch {
+		case v.message != nil:
+			var err error
+			p, err = v.message.marshal()
+			if err != nil {
+				return nil, err
+			}
+		case v.bytes != nil:
+			p = v.bytes
+		default:
+			p = []byte(v.text)
+		}
+		buf := appendKey(nil, field.GetNumber(), 2)
+		buf = append(buf, proto.EncodeVarint(uint64(len(p)))...)
+		return append(buf, p...), nil
+	case google_protobuf.FieldDescriptorProto_TYPE_GROUP:
+		return nil, fmt.Errorf("Groups are not supported")
+	}
+	p, err := encodeScalar(v)
+	if err != nil {
+		return nil, err
+	}
+	return append(appendKey(nil, field.GetNumber(), wireType(field)), p...), nil
+}
+
+func appendKey(buf []byte, fieldNumber int32, wireType int) []byte {
+	return append(buf, proto.EncodeVarint(uint64(fieldNumber)<<3|uint64(wireType))...)
+}
+
+func wireType(field *google_protobuf.FieldDescriptorProto) int {
+	switch field.GetType() {
+	case google_protobuf.FieldDescriptorProto_TYPE_DOUBLE, google_protobuf.FieldDescriptorProto_TYPE_FIXED64,
+		google_protobuf.FieldDescriptorProto_TYPE_SFIXED64:
+		return 1
+	case google_protobuf.FieldDescriptorProto_TYPE_FLOAT, google_protobuf.FieldDescriptorProto_TYPE_FIXED32,
+		google_protobuf.FieldDescriptorProto_TYPE_SFIXED32:
+		return 5
+	case google_protobuf.FieldDescriptorProto_TYPE_STRING, google_protobuf.FieldDescriptorProto_TYPE_BYTES,
+		google_protobuf.FieldDescriptorProto_TYPE_MESSAGE:
+		return 2
+	}
+	return 0
+}
+
+// Encodes the value of a scalar field given in textual form, without a key.
+// Units appended to numbers are ignored, and integers may be given in any
+// base understood by strconv.ParseInt.
+func encodeScalar(v fieldValue) ([]byte, error) {
+	field := v.field
+	s := strings.TrimSpace(v.text)
+	if fields := strings.Fields(s); len(fields) > 1 && field.GetType() != google_protobuf.FieldDescriptorProto_TYPE_STRING {
+		s = fields[0]
+	}
+	switch field.GetType() {
+	case google_protobuf.FieldDescriptorProto_TYPE_DOUBLE:
+		x, err := parseFloat(s, 64)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, math.Float64bits(x))
+		return buf, nil
+	case google_protobuf.FieldDescriptorProto_TYPE_FLOAT:
+		x, err := parseFloat(s, 32)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 4)
+		binary.LittleEndian.PutUint32(buf, math.Float32bits(float32(x)))
+		return buf, nil
+	case google_protobuf.FieldDescriptorProto_TYPE_INT64, google_protobuf.FieldDescriptorProto_TYPE_INT32:
+		x, err := strconv.ParseInt(s, 0, 64)
+		if err != nil {
+			return nil, err
+		}
+		return proto.EncodeVarint(uint64(x)), nil
+	case google_protobuf.FieldDescriptorProto_TYPE_UINT64, google_protobuf.FieldDescriptorProto_TYPE_UINT32:
+		x, err := strconv.ParseUint(s, 0, 64)
+		if err != nil {
+			return nil, err
+		}
+		return proto.EncodeVarint(x), nil
+	case google_protobuf.FieldDescriptorProto_TYPE_SINT32, google_protobuf.FieldDescriptorProto_TYPE_SINT64:
+		x, err := strconv.ParseInt(s, 0, 64)
+		if err != nil {
+			return nil, err
+		}
+		return proto.EncodeVarint(uint64(x<<1) ^ uint64(x>>63)), nil
+	case google_protobuf.FieldDescriptorProto_TYPE_FIXED64:
+		x, err := strconv.ParseUint(s, 0, 64)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, x)
+		return buf, nil
+	case google_protobuf.FieldDescriptorProto_TYPE_SFIXED64:
+		x, err := strconv.ParseInt(s, 0, 64)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, uint64(x))
+		return buf, nil
+	case google_protobuf.FieldDescriptorProto_TYPE_FIXED32:
+		x, err := strconv.ParseUint(s, 0, 32)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 4)
+		binary.LittleEndian.PutUint32(buf, uint32(x))
+		return buf, nil
+	case google_protobuf.FieldDescriptorProto_TYPE_SFIXED32:
+		x, err := strconv.ParseInt(s, 0, 32)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 4)
+		binary.LittleEndian.PutUint32(buf, uint32(x))
+		return buf, nil
+	case google_protobuf.FieldDescriptorProto_TYPE_BOOL:
+		x, err := strconv.ParseBool(strings.ToLower(s))
+		if err != nil {
+			return nil, err
+		}
+		if x {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case google_protobuf.FieldDescriptorProto_TYPE_ENUM:
+		x, err := enumValue(v.enum, field.GetTypeName(), s)
+		if err != nil {
+			return nil, err
+		}
+		return proto.EncodeVarint(uint64(x)), nil
+	}
+	return nil, fmt.Errorf("Cannot encode %s as a scalar", field.GetName())
+}
+
+// Parses a float, accepting the spellings of infinity used by the JSON mapping.
+func parseFloat(s string, bitSize int) (float64, error) {
+	switch s {
+	case "Infinity":
+		return math.Inf(1), nil
+	case "-Infinity":
+		return math.Inf(-1), nil
+	}
+	return strconv.ParseFloat(s, bitSize)
+}
+
+// Gets the number of the value called s of the enum typeName. s may also be
+// the number itself.
+func enumValue(e *google_protobuf.EnumDescriptorProto, typeName string, s string) (int64, error) {
+	if e == nil {
+		return 0, fmt.Errorf("Cannot find enum: %s", typeName)
+	}
+	for _, value := range e.GetValue() {
+		if value.GetName() == s {
+			return int64(value.GetNumber()), nil
+		}
+	}
+	if x, err := strconv.ParseInt(s, 0, 32); err == nil {
+		return x, nil
+	}
+	return 0, fmt.Errorf("Invalid enum value: %s, for enum: %s", s, e.GetName())
+}
@@ -0,0 +1,215 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package marshal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/elrichgro/protofuse/fuse"
+	"github.com/elrichgro/protofuse/test"
+	"github.com/elrichgro/protofuse/unmarshal"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+)
+
+func TestDirectory(t *testing.T) {
+	buf, fDesc, packageName, messageName, err := test.GenerateFull()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []unmarshal.Options{
+		{},
+		{Bytes: unmarshal.BytesHexdump},
+		{Bytes: unmarshal.BytesBase64, BytesViews: []unmarshal.BytesFormat{unmarshal.BytesRaw}},
+		{BytesViews: []unmarshal.BytesFormat{unmarshal.BytesRaw}, Naming: unmarshal.Naming{Pad: true, Subdirs: true}},
+		{Bytes: unmarshal.BytesRaw, Naming: unmarshal.Naming{Extensions: true}},
+		{BytesViews: []unmarshal.BytesFormat{unmarshal.BytesHex}, Naming: unmarshal.Naming{Subdirs: true, Extensions: true}},
+	} {
+		PT, err := unmarshal.UnmarshalOptions(fDesc, packageName, messageName, [][]byte{buf}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dir, err := ioutil.TempDir("", "protofuse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		err = PT.Dir.Extract(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		packed, err := Directory(fDesc, packageName, messageName, filepath.Join(dir, "Message_1"), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want, got := &test.Foo{}, &test.Foo{}
+		if err := proto.Unmarshal(buf, want); err != nil {
+			t.Fatal(err)
+		}
+		if err := proto.Unmarshal(packed, got); err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(want, got) {
+			t.Error(fmt.Sprintf("Bytes format %v: packed message %v does not match %v", opts.Bytes, got, want))
+		}
+	}
+}
+
+// Extracts the first message of buf decoded under opts to a temporary
+// directory, and packs it again.
+func extractAndPack(buf []byte, fDesc *google_protobuf.FileDescriptorSet, opts unmarshal.Options) ([]byte, error) {
+	PT, err := unmarshal.UnmarshalOptions(fDesc, "test", "foo", [][]byte{buf}, opts)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "protofuse")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err := PT.Dir.Extract(dir); err != nil {
+		return nil, err
+	}
+	return Directory(fDesc, "test", "foo", filepath.Join(dir, "Message_1"), opts)
+}
+
+func TestDirectoryAnnotations(t *testing.T) {
+	buf, fDesc, _, _, err := test.GenerateFull()
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Annotate(fDesc, "f11", "format", "base64")
+	annotations := unmarshal.Annotations{Sensitive: "sensitive", Format: "format"}
+
+	// f11 is shown in base64 by its option, and read back the same way
+	packed, err := extractAndPack(buf, fDesc, unmarshal.Options{Annotations: annotations})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, got := &test.Foo{}, &test.Foo{}
+	if err := proto.Unmarshal(buf, want); err != nil {
+		t.Fatal(err)
+	}
+	if err := proto.Unmarshal(packed, got); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(want, got) {
+		t.Error(fmt.Sprintf("Packed message %v does not match %v", got, want))
+	}
+
+	if _, err := extractAndPack(buf, fDesc, unmarshal.Options{Bytes: unmarshal.BytesAuto}); err == nil {
+		t.Error("Expected bytes shown as auto not to be packed")
+	}
+
+	// f1 is a string, which would otherwise be packed as REDACTED
+	test.Annotate(fDesc, "f1", "sensitive", true)
+	if _, err := extractAndPack(buf, fDesc, unmarshal.Options{Annotations: annotations}); err == nil {
+		t.Error("Expected a redacted string not to be packed")
+	}
+}
+
+func TestDirectoryFloats(t *testing.T) {
+	full, fDesc, _, _, err := test.GenerateFull()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []struct {
+		f10 float64
+		f15 float32
+	}{
+		{1.234567891234, 1.23e-05},
+		{-0.1, 3.4028235e+38},
+		{1e-300, 1.401298464324817e-45},
+		{math.Inf(1), float32(math.Inf(-1))},
+	} {
+		want := &test.Foo{}
+		if err := proto.Unmarshal(full, want); err != nil {
+			t.Fatal(err)
+		}
+		want.F10, want.F15 = proto.Float64(f.f10), proto.Float32(f.f15)
+		buf, err := proto.Marshal(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packed, err := extractAndPack(buf, fDesc, unmarshal.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := &test.Foo{}
+		if err := proto.Unmarshal(packed, got); err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(want, got) {
+			t.Error(fmt.Sprintf("Packed message %v does not match %v", got, want))
+		}
+	}
+
+	// a format option rounds f10, which cannot be packed again
+	test.Annotate(fDesc, "f10", "format", "%.2f")
+	if _, err := extractAndPack(full, fDesc, unmarshal.Options{Annotations: unmarshal.Annotations{Format: "format"}}); err == nil {
+		t.Error("Expected a rounded double not to be packed")
+	}
+}
+
+func TestTextAndJSON(t *testing.T) {
+	buf, fDesc, packageName, messageName, err := test.GenerateFull()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	PT, err := unmarshal.Unmarshal(fDesc, packageName, messageName, [][]byte{buf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := PT.Dir.Nodes[0].Node.(*pfuse.Dir)
+
+	js, err := dir.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON, err := JSON(fDesc, packageName, messageName, js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromText, err := Text(fDesc, packageName, messageName, dir.Text())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &test.Foo{}
+	if err := proto.Unmarshal(buf, want); err != nil {
+		t.Fatal(err)
+	}
+	for format, p := range map[string][]byte{"JSON": fromJSON, "text": fromText} {
+		got := &test.Foo{}
+		if err := proto.Unmarshal(p, got); err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(want, got) {
+			t.Error(fmt.Sprintf("Message from %s %v does not match %v", format, got, want))
+		}
+	}
+}
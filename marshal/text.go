@@ -0,0 +1,396 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package marshal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+)
+
+// Text encodes the message of type messageName in package packageName given
+// in the protocol buffer text format.
+func Text(fDesc *google_protobuf.FileDescriptorSet, packageName string, messageName string, data []byte) ([]byte, error) {
+	m, err := newEncoder(fDesc).newMessage(qualify(packageName, messageName))
+	if err != nil {
+		return nil, err
+	}
+	t := &textScanner{s: string(data), line: 1}
+	err = readText(m, t, "")
+	if err != nil {
+		return nil, err
+	}
+	return m.marshal()
+}
+
+// Splits the text format into tokens: punctuation, quoted strings and runs
+// of identifier and number characters.
+type textScanner struct {
+	s    string
+	pos  int
+	line int
+}
+
+func (t *textScanner) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("line %d: %s", t.line, fmt.Sprintf(format, a...))
+}
+
+// Skips whitespace and comments.
+func (t *textScanner) skip() {
+	for t.pos < len(t.s) {
+		switch c := t.s[t.pos]; {
+		case c == '\n':
+			t.line++
+			t.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			t.pos++
+		case c == '#':
+			for t.pos < len(t.s) && t.s[t.pos] != '\n' {
+				t.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Gets the next token, or "" at the end of the input.
+func (t *textScanner) next() (string, error) {
+	t.skip()
+	if t.pos == len(t.s) {
+		return "", nil
+	}
+	start := t.pos
+	switch c := t.s[t.pos]; {
+	case strings.IndexByte("{}[]<>:,;/", c) >= 0:
+		t.pos++
+	case c == '"' || c == '\'':
+		t.pos++
+		for t.pos < len(t.s) && t.s[t.pos] != c {
+			if t.s[t.pos] == '\n' {
+				return "", t.errorf("unterminated string")
+			}
+			if t.s[t.pos] == '\\' {
+				t.pos++
+			}
+			t.pos++
+		}
+		if t.pos >= len(t.s) {
+			return "", t.errorf("unterminated string")
+		}
+		t.pos++
+	case isIdentChar(c):
+		for t.pos < len(t.s) && isIdentChar(t.s[t.pos]) {
+			t.pos++
+		}
+	default:
+		return "", t.errorf("unexpected character %q", c)
+	}
+	return t.s[start:t.pos], nil
+}
+
+// Gets the next token without consuming it.
+func (t *textScanner) peek() (string, error) {
+	pos, line := t.pos, t.line
+	tok, err := t.next()
+	t.pos, t.line = pos, line
+	return tok, err
+}
+
+// Reads the name of an extension or Any type up to the closing bracket.
+func (t *textScanner) bracketed() (string, error) {
+	i := strings.IndexByte(t.s[t.pos:], ']')
+	if i < 0 {
+		return "", t.errorf("missing ]")
+	}
+	name := strings.TrimSpace(t.s[t.pos : t.pos+i])
+	t.line += strings.Count(name, "\n")
+	t.pos += i + 1
+	return name, nil
+}
+
+func isIdentChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '_' || c == '.' || c == '+' || c == '-'
+}
+
+// Closing delimiters of messages.
+var closing = map[string]string{"{": "}", "<": ">"}
+
+// Adds the fields of m up to the delimiter end, or to the end of the input
+// if end is empty.
+func readText(m *message, t *textScanner, end string) error {
+	counts := make(map[*google_protobuf.FieldDescriptorProto]int)
+	for {
+		tok, err := t.next()
+		if err != nil {
+			return err
+		}
+		if tok == end {
+			return nil
+		}
+		if tok == "" {
+			return t.errorf("unexpected end of input in %s", m.typeName[1:])
+		}
+
+		var field *google_protobuf.FieldDescriptorProto
+		if tok == "[" {
+			name, err := t.bracketed()
+			if err != nil {
+				return err
+			}
+			if strings.Contains(name, "/") {
+				err = readTextAny(m, t, name)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			field = m.findField(name)
+			tok = name
+		} else {
+			field = m.findField(tok)
+		}
+		if field == nil {
+			return t.errorf("no field %s in %s", tok, m.typeName[1:])
+		}
+
+		err = readTextField(m, field, t, counts)
+		if err != nil {
+			return err
+		}
+		if sep, _ := t.peek(); sep == "," || sep == ";" {
+			t.next()
+		}
+	}
+}
+
+// Adds the value, or list of values, of field to m.
+func readTextField(m *message, field *google_protobuf.FieldDescriptorProto, t *textScanner, counts map[*google_protobuf.FieldDescriptorProto]int) error {
+	tok, err := t.peek()
+	if err != nil {
+		return err
+	}
+	if tok == ":" {
+		t.next()
+		tok, _ = t.peek()
+	} else if field.GetType() != google_protobuf.FieldDescriptorProto_TYPE_MESSAGE {
+		return t.errorf("expected : after %s", field.GetName())
+	}
+	if tok != "[" {
+		return readTextValue(m, field, t, counts)
+	}
+
+	t.next()
+	if tok, _ = t.peek(); tok == "]" {
+		t.next()
+		return nil
+	}
+	for {
+		err = readTextValue(m, field, t, counts)
+		if err != nil {
+			return err
+		}
+		tok, err = t.next()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case "]":
+			return nil
+		case ",":
+		default:
+			return t.errorf("expected , or ] in list of %s", field.GetName())
+		}
+	}
+}
+
+// Adds one value of field to m.
+func readTextValue(m *message, field *google_protobuf.FieldDescriptorProto, t *textScanner, counts map[*google_protobuf.FieldDescriptorProto]int) error {
+	v := fieldValue{field: field, index: counts[field]}
+	counts[field]++
+
+	tok, err := t.next()
+	if err != nil {
+		return err
+	}
+	switch {
+	case field.GetType() == google_protobuf.FieldDescriptorProto_TYPE_MESSAGE:
+		end, ok := closing[tok]
+		if !ok {
+			return t.errorf("expected { after %s", field.GetName())
+		}
+		nested, err := m.enc.newMessage(field.GetTypeName())
+		if err != nil {
+			return err
+		}
+		err = readText(nested, t, end)
+		if err != nil {
+			return err
+		}
+		v.message = nested
+	case tok != "" && (tok[0] == '"' || tok[0] == '\''):
+		// adjacent strings are concatenated
+		var p []byte
+		for {
+			s, err := textUnquote(tok)
+			if err != nil {
+				return t.errorf("%v", err)
+			}
+			p = append(p, s...)
+			next, _ := t.peek()
+			if next == "" || next[0] != '"' && next[0] != '\'' {
+				break
+			}
+			tok, _ = t.next()
+		}
+		if field.GetType() == google_protobuf.FieldDescriptorProto_TYPE_BYTES {
+			v.bytes = append([]byte{}, p...)
+		} else {
+			v.text = string(p)
+		}
+	case tok == "" || !isIdentChar(tok[0]):
+		return t.errorf("expected value for %s", field.GetName())
+	default:
+		v.text = textNumber(field, tok)
+	}
+	m.add(v)
+	return nil
+}
+
+// Adds the type URL and value of an Any given in its expanded form,
+// [type.googleapis.com/package.Message] { ... }.
+func readTextAny(m *message, t *textScanner, url string) error {
+	if m.typeName != ".google.protobuf.Any" {
+		return t.errorf("[%s] outside google.protobuf.Any", url)
+	}
+	tok, err := t.next()
+	if err != nil {
+		return err
+	}
+	if tok == ":" {
+		tok, _ = t.next()
+	}
+	end, ok := closing[tok]
+	if !ok {
+		return t.errorf("expected { after [%s]", url)
+	}
+	packed, err := m.enc.newMessage("." + url[strings.LastIndex(url, "/")+1:])
+	if err != nil {
+		return err
+	}
+	err = readText(packed, t, end)
+	if err != nil {
+		return err
+	}
+	for _, field := range m.desc.GetField() {
+		switch field.GetNumber() {
+		case 1:
+			m.add(fieldValue{field: field, text: url})
+		case 2:
+			m.add(fieldValue{field: field, message: packed})
+		}
+	}
+	return nil
+}
+
+// Converts the spellings of numbers allowed by the text format to ones
+// understood by encodeScalar.
+func textNumber(field *google_protobuf.FieldDescriptorProto, s string) string {
+	switch field.GetType() {
+	case google_protobuf.FieldDescriptorProto_TYPE_DOUBLE, google_protobuf.FieldDescriptorProto_TYPE_FLOAT:
+		switch strings.ToLower(strings.TrimPrefix(s, "-")) {
+		case "inf", "infinity":
+			if strings.HasPrefix(s, "-") {
+				return "-Infinity"
+			}
+			return "Infinity"
+		case "nan":
+			return "NaN"
+		}
+		return strings.TrimRight(s, "fF")
+	}
+	return s
+}
+
+// Unquotes a string of the text format, which uses the escapes of C.
+func textUnquote(s string) ([]byte, error) {
+	quote := s[0]
+	s = s[1 : len(s)-1]
+	var p []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' {
+			p = append(p, c)
+			continue
+		}
+		i++
+		if i == len(s) {
+			return nil, fmt.Errorf("invalid escape at end of %c%s%c", quote, s, quote)
+		}
+		switch c = s[i]; c {
+		case 'a':
+			p = append(p, '\a')
+		case 'b':
+			p = append(p, '\b')
+		case 'f':
+			p = append(p, '\f')
+		case 'n':
+			p = append(p, '\n')
+		case 'r':
+			p = append(p, '\r')
+		case 't':
+			p = append(p, '\t')
+		case 'v':
+			p = append(p, '\v')
+		case '\\', '\'', '"', '?':
+			p = append(p, c)
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			j := i
+			for j < len(s) && j < i+3 && '0' <= s[j] && s[j] <= '7' {
+				j++
+			}
+			x, err := strconv.ParseUint(s[i:j], 8, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid octal escape \\%s", s[i:j])
+			}
+			p = append(p, byte(x))
+			i = j - 1
+		case 'x', 'X', 'u', 'U':
+			n := map[byte]int{'x': 2, 'X': 2, 'u': 4, 'U': 8}[c]
+			j := i + 1
+			for j < len(s) && j < i+1+n && strings.IndexByte("0123456789abcdefABCDEF", s[j]) >= 0 {
+				j++
+			}
+			x, err := strconv.ParseUint(s[i+1:j], 16, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid escape \\%s", s[i:j])
+			}
+			if c == 'x' || c == 'X' {
+				p = append(p, byte(x))
+			} else {
+				var r [utf8.UTFMax]byte
+				p = append(p, r[:utf8.EncodeRune(r[:], rune(x))]...)
+			}
+			i = j - 1
+		default:
+			return nil, fmt.Errorf("invalid escape \\%c", c)
+		}
+	}
+	return p, nil
+}
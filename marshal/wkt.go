@@ -0,0 +1,255 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package marshal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+)
+
+// Types of the value field of the wrapper types.
+var wrapperTypes = map[string]google_protobuf.FieldDescriptorProto_Type{
+	".google.protobuf.DoubleValue": google_protobuf.FieldDescriptorProto_TYPE_DOUBLE,
+	".google.protobuf.FloatValue":  google_protobuf.FieldDescriptorProto_TYPE_FLOAT,
+	".google.protobuf.Int64Value":  google_protobuf.FieldDescriptorProto_TYPE_INT64,
+	".google.protobuf.UInt64Value": google_protobuf.FieldDescriptorProto_TYPE_UINT64,
+	".google.protobuf.Int32Value":  google_protobuf.FieldDescriptorProto_TYPE_INT32,
+	".google.protobuf.UInt32Value": google_protobuf.FieldDescriptorProto_TYPE_UINT32,
+	".google.protobuf.BoolValue":   google_protobuf.FieldDescriptorProto_TYPE_BOOL,
+	".google.protobuf.StringValue": google_protobuf.FieldDescriptorProto_TYPE_STRING,
+	".google.protobuf.BytesValue":  google_protobuf.FieldDescriptorProto_TYPE_BYTES,
+}
+
+// Reports whether typeName is a well-known type with a JSON form of its own.
+func isWellKnown(typeName string) bool {
+	if _, ok := wrapperTypes[typeName]; ok {
+		return true
+	}
+	switch typeName {
+	case ".google.protobuf.Timestamp", ".google.protobuf.Duration", ".google.protobuf.Struct",
+		".google.protobuf.Value", ".google.protobuf.ListValue", ".google.protobuf.FieldMask",
+		".google.protobuf.Empty":
+		return true
+	}
+	return false
+}
+
+// Encodes the well-known type typeName from its canonical JSON form s, as
+// shown by protofuse. Strings are given without quotes.
+func encodeWellKnown(typeName string, s string) ([]byte, error) {
+	if t, ok := wrapperTypes[typeName]; ok {
+		field := &google_protobuf.FieldDescriptorProto{Name: proto.String("value"), Number: proto.Int32(1), Type: t.Enum()}
+		v := fieldValue{field: field, text: s}
+		if t == google_protobuf.FieldDescriptorProto_TYPE_BYTES {
+			p, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return nil, err
+			}
+			v.bytes = p
+		}
+		return v.encode()
+	}
+	switch typeName {
+	case ".google.protobuf.Timestamp":
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, err
+		}
+		return encodeSecondsNanos(t.Unix(), int64(t.Nanosecond())), nil
+	case ".google.protobuf.Duration":
+		return encodeDuration(s)
+	case ".google.protobuf.Struct", ".google.protobuf.Value", ".google.protobuf.ListValue":
+		var v interface{}
+		d := json.NewDecoder(strings.NewReader(s))
+		d.UseNumber()
+		if err := d.Decode(&v); err != nil {
+			return nil, err
+		}
+		switch typeName {
+		case ".google.protobuf.Struct":
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Struct: expected a JSON object, got %s", s)
+			}
+			return encodeStruct(m)
+		case ".google.protobuf.ListValue":
+			l, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("ListValue: expected a JSON array, got %s", s)
+			}
+			return encodeListValue(l)
+		}
+		return encodeValue(v)
+	case ".google.protobuf.FieldMask":
+		var buf []byte
+		if s == "" {
+			return buf, nil
+		}
+		for _, path := range strings.Split(s, ",") {
+			buf = appendBytes(buf, 1, []byte(snakeCase(path)))
+		}
+		return buf, nil
+	case ".google.protobuf.Empty":
+		return []byte{}, nil
+	}
+	return nil, fmt.Errorf("Not a well-known type: %s", typeName)
+}
+
+func appendBytes(buf []byte, fieldNumber int32, p []byte) []byte {
+	buf = appendKey(buf, fieldNumber, 2)
+	buf = append(buf, proto.EncodeVarint(uint64(len(p)))...)
+	return append(buf, p...)
+}
+
+func encodeSecondsNanos(seconds int64, nanos int64) []byte {
+	var buf []byte
+	if seconds != 0 {
+		buf = append(appendKey(buf, 1, 0), proto.EncodeVarint(uint64(seconds))...)
+	}
+	if nanos != 0 {
+		buf = append(appendKey(buf, 2, 0), proto.EncodeVarint(uint64(nanos))...)
+	}
+	return buf
+}
+
+// Encodes a duration such as "-1.5s".
+func encodeDuration(s string) ([]byte, error) {
+	if !strings.HasSuffix(s, "s") {
+		return nil, fmt.Errorf("Duration: missing unit in %s", s)
+	}
+	d := strings.TrimSuffix(s, "s")
+	sign := int64(1)
+	if strings.HasPrefix(d, "-") {
+		sign = -1
+		d = d[1:]
+	}
+	secondsPart, nanosPart := d, ""
+	if i := strings.Index(d, "."); i >= 0 {
+		secondsPart, nanosPart = d[:i], d[i+1:]
+	}
+	seconds, err := strconv.ParseInt(secondsPart, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Duration: invalid seconds in %s", s)
+	}
+	var nanos int64
+	if nanosPart != "" {
+		if len(nanosPart) > 9 {
+			return nil, fmt.Errorf("Duration: too many fractional digits in %s", s)
+		}
+		nanos, err = strconv.ParseInt(nanosPart+strings.Repeat("0", 9-len(nanosPart)), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Duration: invalid nanos in %s", s)
+		}
+	}
+	return encodeSecondsNanos(sign*seconds, sign*nanos), nil
+}
+
+func encodeStruct(m map[string]interface{}) ([]byte, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf []byte
+	for _, k := range keys {
+		value, err := encodeValue(m[k])
+		if err != nil {
+			return nil, err
+		}
+		entry := appendBytes(appendBytes(nil, 1, []byte(k)), 2, value)
+		buf = appendBytes(buf, 1, entry)
+	}
+	return buf, nil
+}
+
+func encodeListValue(l []interface{}) ([]byte, error) {
+	var buf []byte
+	for _, v := range l {
+		value, err := encodeValue(v)
+		if err != nil {
+			return nil, err
+		}
+		buf = appendBytes(buf, 1, value)
+	}
+	return buf, nil
+}
+
+// Encodes a google.protobuf.Value from a value decoded by encoding/json.
+func encodeValue(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(appendKey(nil, 1, 0), 0), nil
+	case json.Number:
+		x, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return encodeNumberValue(x), nil
+	case float64:
+		return encodeNumberValue(v), nil
+	case string:
+		return appendBytes(nil, 3, []byte(v)), nil
+	case bool:
+		var b byte
+		if v {
+			b = 1
+		}
+		return append(appendKey(nil, 4, 0), b), nil
+	case map[string]interface{}:
+		p, err := encodeStruct(v)
+		if err != nil {
+			return nil, err
+		}
+		return appendBytes(nil, 5, p), nil
+	case []interface{}:
+		p, err := encodeListValue(v)
+		if err != nil {
+			return nil, err
+		}
+		return appendBytes(nil, 6, p), nil
+	}
+	return nil, fmt.Errorf("Value: cannot encode %v", v)
+}
+
+func encodeNumberValue(x float64) []byte {
+	buf := appendKey(nil, 2, 1)
+	p := make([]byte, 8)
+	binary.LittleEndian.PutUint64(p, math.Float64bits(x))
+	return append(buf, p...)
+}
+
+// Converts a lowerCamelCase path of a field mask back to field names.
+func snakeCase(path string) string {
+	var b bytes.Buffer
+	for _, c := range path {
+		if 'A' <= c && c <= 'Z' {
+			b.WriteByte('_')
+			c += 'a' - 'A'
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
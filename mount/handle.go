@@ -0,0 +1,340 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package mount
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+
+	"github.com/elrichgro/protofuse/fuse"
+	"github.com/elrichgro/protofuse/input"
+	"github.com/elrichgro/protofuse/unmarshal"
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+)
+
+// Schema names the message type of the protocol buffers being mounted.
+type Schema struct {
+	FileDesc    *google_protobuf.FileDescriptorSet
+	PackageName string
+	MessageName string
+}
+
+// Source is what a mount shows: marshaled messages, a tree that has already
+// been built, a stream that is read once the mount is up, or several named
+// sources.
+type Source struct {
+	multi   *pfuse.Multi
+	tree    *pfuse.ProtoTree
+	entries []unmarshal.Entry
+	reader  io.Reader
+	decode  func([]byte) ([]unmarshal.Entry, error)
+}
+
+// Messages is a source showing the marshaled messages in buf as
+// Message_1, Message_2 and so on. Compressed messages are decompressed.
+func Messages(buf [][]byte) Source {
+	return Source{entries: unmarshal.MessageEntries(buf)}
+}
+
+// Entries is a source showing each of entries at the root of the mount.
+// Compressed entries are decompressed.
+func Entries(entries []unmarshal.Entry) Source {
+	return Source{entries: entries}
+}
+
+// Tree is a source showing a tree built by Load. The schema is not used.
+func Tree(PT *pfuse.ProtoTree) Source {
+	return Source{tree: PT}
+}
+
+// Stream is a source reading r into memory in the background while it is
+// mounted, so the input may arrive afterwards, e.g. from a pipe. The input
+// is decoded as a whole once r reaches EOF; until then lookups in the
+// mount block.
+// decode splits what is read into the entries of the tree.
+func Stream(r io.Reader, decode func([]byte) ([]unmarshal.Entry, error)) Source {
+	return Source{reader: r, decode: decode}
+}
+
+// Sources is a source showing the trees of m, each in a directory named
+// after it, that can be added and removed while mounted. The schema is not
+// used.
+func Sources(m *pfuse.Multi) Source {
+	return Source{multi: m}
+}
+
+type config struct {
+	options unmarshal.Options
+}
+
+// Option configures a mount made by New.
+type Option func(*config)
+
+// WithOptions presents the decoded values according to opts.
+func WithOptions(opts unmarshal.Options) Option {
+	return func(c *config) {
+		c.options = opts
+	}
+}
+
+// Handle is a mounted filesystem.
+type Handle struct {
+	mountPoint string
+	conn       *fuse.Conn
+	server     *fs.Server
+	// live is the filesystem of sources other than streams, whose tree
+	// can be replaced by Update.
+	live  *pfuse.Live
+	ready chan struct{}
+	done  chan struct{}
+	err   error
+	// closeMu serializes Close, and unmounted is set once an unmount has
+	// succeeded.
+	closeMu   sync.Mutex
+	unmounted bool
+}
+
+// New mounts source at mountPoint and serves it in the background until
+// the handle is closed, ctx is cancelled or the filesystem is unmounted
+// from outside. It returns once the mount point can be used, or with the
+// error that stopped the mount. Signal handling is left to the caller.
+func New(ctx context.Context, mountPoint string, source Source, schema Schema, opts ...Option) (*Handle, error) {
+	var c config
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	// a mount left behind by a process that died would make mounting fail
+	if stale, err := CleanStale(mountPoint); err != nil {
+		return nil, err
+	} else if stale {
+		log.Printf("unmounted stale mount point %s", mountPoint)
+	}
+
+	// the input is decoded first, so that input which cannot be decoded is
+	// never mounted
+	filesystem, live, err := build(source, schema, c)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	conn, err := fuse.Mount(
+		mountPoint,
+		fuse.FSName("protofuse"),
+		fuse.Subtype("protofs"),
+		fuse.LocalVolume(),
+		fuse.VolumeName("ProtoFS"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Handle{
+		mountPoint: mountPoint,
+		conn:       conn,
+		server:     fs.New(conn, nil),
+		live:       live,
+		ready:      make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	if m := source.multi; m != nil {
+		// invalidations wait for the kernel, so are not sent from within
+		// the request that changed the sources
+		m.Invalidate = func(name string) {
+			go func() {
+				h.server.InvalidateEntry(m, name)
+				h.server.InvalidateNodeData(m)
+			}()
+		}
+	}
+	go func() {
+		defer close(h.done)
+		defer conn.Close()
+		h.err = h.server.Serve(filesystem)
+	}()
+
+	// wait for the kernel to acknowledge the mount, which on some platforms
+	// needs the filesystem to be served already
+	select {
+	case <-conn.Ready:
+	case <-h.done:
+		if h.err != nil {
+			return nil, h.err
+		}
+		return nil, fmt.Errorf("Filesystem at %s stopped before it was mounted", mountPoint)
+	case <-ctx.Done():
+		h.Close()
+		return nil, ctx.Err()
+	}
+	if err := conn.MountError; err != nil {
+		conn.Close()
+		<-h.done
+		return nil, err
+	}
+	close(h.ready)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := h.Close(); err != nil {
+				log.Printf("unmounting %s: %v", mountPoint, err)
+			}
+		case <-h.done:
+		}
+	}()
+	return h, nil
+}
+
+// Builds the filesystem showing source, and the Live filesystem it is if
+// its tree can be replaced.
+func build(source Source, schema Schema, c config) (fs.FS, *pfuse.Live, error) {
+	switch {
+	case source.multi != nil:
+		return source.multi, nil, nil
+	case source.tree != nil:
+		if source.tree.Dir.Stat == nil {
+			source.tree.SetStat("", pfuse.NewStat(time.Now()))
+		}
+		live := pfuse.NewLive(source.tree)
+		return live, live, nil
+	case source.reader != nil:
+		pending := pfuse.NewPending()
+		go func() {
+			PT, err := Load(source.reader, source.decode, schema.FileDesc, schema.PackageName, schema.MessageName, c.options)
+			if err != nil {
+				log.Printf("reading input: %v", err)
+			}
+			pending.Set(PT, err)
+		}()
+		return pending, nil, nil
+	default:
+		entries, err := decompress(source.entries)
+		if err != nil {
+			return nil, nil, err
+		}
+		PT, err := unmarshal.UnmarshalEntries(schema.FileDesc, schema.PackageName, schema.MessageName, entries, c.options)
+		if err != nil {
+			return nil, nil, err
+		}
+		PT.SetStat("", pfuse.NewStat(time.Now()))
+		live := pfuse.NewLive(PT)
+		return live, live, nil
+	}
+}
+
+// Gets entries with the data of each decompressed if it is compressed, as
+// it is when read by Load.
+func decompress(entries []unmarshal.Entry) ([]unmarshal.Entry, error) {
+	out := make([]unmarshal.Entry, len(entries))
+	for i, entry := range entries {
+		out[i] = entry
+		if entry.Data == nil {
+			continue
+		}
+		data, err := input.Decompress(entry.Data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", entry.Name, err)
+		}
+		out[i].Data = data
+	}
+	return out, nil
+}
+
+// Update replaces the tree shown by the mount with PT, keeping the mount
+// point and, through SetStat, the inode numbers of unchanged paths, and
+// tells the kernel to drop what it has cached of the paths that changed.
+// Files open in the old tree keep showing their old contents. Mounts of a
+// Stream or of Sources cannot be updated.
+func (h *Handle) Update(PT *pfuse.ProtoTree) error {
+	if h.live == nil {
+		return fmt.Errorf("Cannot update the mount at %s, its tree cannot be replaced", h.mountPoint)
+	}
+	if PT.Dir.Stat == nil {
+		PT.SetStat("", pfuse.NewStat(time.Now()))
+	}
+	invalidations := h.live.Swap(PT)
+	// fuse.ErrNotCached only means there was nothing to drop
+	if err := h.server.InvalidateNodeData(h.live); err != nil && err != fuse.ErrNotCached {
+		return err
+	}
+	for _, inv := range invalidations {
+		var err error
+		if inv.Name == "" {
+			err = h.server.InvalidateNodeData(inv.Node)
+		} else {
+			err = h.server.InvalidateEntry(inv.Node, inv.Name)
+		}
+		if err != nil && err != fuse.ErrNotCached {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ready is closed once the kernel has acknowledged the mount. New only
+// returns once it is, so it is always closed for a handle New returned.
+func (h *Handle) Ready() <-chan struct{} {
+	return h.ready
+}
+
+// Done is closed once the filesystem has stopped being served.
+func (h *Handle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Wait blocks until the filesystem has stopped being served, returning the
+// error that stopped it, if any.
+func (h *Handle) Wait() error {
+	<-h.done
+	if h.err != nil {
+		return h.err
+	}
+	return h.conn.MountError
+}
+
+// Close unmounts the filesystem and waits for it to stop being served. An
+// unmount that fails, as it does while the mount point is busy, is tried
+// again by the next call.
+func (h *Handle) Close() error {
+	h.closeMu.Lock()
+	select {
+	case <-h.done:
+	default:
+		if !h.unmounted {
+			if err := fuse.Unmount(h.mountPoint); err != nil {
+				h.closeMu.Unlock()
+				return err
+			}
+			h.unmounted = true
+		}
+	}
+	h.closeMu.Unlock()
+	return h.Wait()
+}
+
+// MountPoint gets the directory the filesystem is mounted at.
+func (h *Handle) MountPoint() string {
+	return h.mountPoint
+}
@@ -16,114 +16,91 @@
 package mount
 
 import (
+	"context"
 	"fmt"
-	"log"
-	"strings"
-	"os/signal"
+	"io"
+	"io/ioutil"
 	"os"
+	"strings"
+	"time"
 
 	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
 
+	"github.com/elrichgro/protofuse/fuse"
+	"github.com/elrichgro/protofuse/input"
 	"github.com/elrichgro/protofuse/unmarshal"
 	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
 )
 
 //	Mounts a marshaled protocol buffer as a filesytem. 
 func Mount(marshaled []byte, fileDesc *google_protobuf.FileDescriptorSet, packageName string, messageName string, mountPoint string) error {
-	// mount
-	c, err := fuse.Mount(
-		mountPoint,
-		fuse.FSName("protofuse"),
-		fuse.Subtype("protofs"),
-		fuse.LocalVolume(),
-		fuse.VolumeName("ProtoFS"),
-	)
-	if err != nil {
-		return err
-	}
-	defer c.Close()
+	return MountListOptions([][]byte{marshaled}, fileDesc, packageName, messageName, mountPoint, unmarshal.Options{})
+}
 
-	// unmount filesystem in the event of an interrupt
-	c1 := make(chan os.Signal, 1)
-	signal.Notify(c1, os.Interrupt)
-	go func(){
-    for sig := range c1 {
-    	log.Printf("captured %v, unmounting filesystem", sig)
-        err = fuse.Unmount(mountPoint)
-		if err != nil {
-			log.Println(err)
-		}
-    }
-	}()
+// Mounts a list of marshaled protocol buffers as a filesystem.
+func MountList(marshaled [][]byte, fileDesc *google_protobuf.FileDescriptorSet, packageName string, messageName string, mountPoint string) error {
+	return MountListOptions(marshaled, fileDesc, packageName, messageName, mountPoint, unmarshal.Options{})
+}
 
-	// create the filesystem structure
-	PT, err := unmarshal.Unmarshal(fileDesc, packageName, messageName, [][]byte{marshaled})
-	if err != nil {
-		return err
-	}
+// Mounts a list of marshaled protocol buffers as a filesystem, presenting
+// the decoded values according to opts.
+func MountListOptions(marshaled [][]byte, fileDesc *google_protobuf.FileDescriptorSet, packageName string, messageName string, mountPoint string, opts unmarshal.Options) error {
+	return mountAndWait(mountPoint, Messages(marshaled), Schema{fileDesc, packageName, messageName}, WithOptions(opts))
+}
 
-	// serve
-	err = fs.Serve(c, PT)
-	if err != nil {
-		return err
-	}
-	// check if the mount process has an error to report
-	<-c.Ready
-	if err := c.MountError; err != nil {
-		return err
-	}
+// Mounts the protocol buffers read from r as a filesystem. The mount is
+// established before r is read, so the input may arrive afterwards, e.g.
+// from a pipe. It is read into memory and decoded once r reaches EOF;
+// until then lookups in the mount wait for it. decode splits
+// what is read into the entries of the tree.
+func MountReader(r io.Reader, decode func([]byte) ([]unmarshal.Entry, error), fileDesc *google_protobuf.FileDescriptorSet, packageName string, messageName string, mountPoint string, opts unmarshal.Options) error {
+	return mountAndWait(mountPoint, Stream(r, decode), Schema{fileDesc, packageName, messageName}, WithOptions(opts))
+}
 
-	return nil
+// Mounts a tree built by Load as a filesystem.
+func MountTree(PT *pfuse.ProtoTree, mountPoint string) error {
+	return mountAndWait(mountPoint, Tree(PT), Schema{})
 }
 
-// Mounts a list of marshaled protocol buffers as a filesystem.
-func MountList(marshaled [][]byte, fileDesc *google_protobuf.FileDescriptorSet, packageName string, messageName string, mountPoint string) error {
-	// mount
-	c, err := fuse.Mount(
-		mountPoint,
-		fuse.FSName("protofuse"),
-		fuse.Subtype("protofs"),
-		fuse.LocalVolume(),
-		fuse.VolumeName("ProtoFS"),
-	)
+func mountAndWait(mountPoint string, source Source, schema Schema, opts ...Option) error {
+	h, err := New(context.Background(), mountPoint, source, schema, opts...)
 	if err != nil {
 		return err
 	}
-	defer c.Close()
-
-	// unmount the filesystem in the event of an interrupt
-	c1 := make(chan os.Signal, 1)
-	signal.Notify(c1, os.Interrupt)
-	go func(){
-    for sig := range c1 {
-    	log.Printf("captured %v, unmounting filesystem", sig)
-        err = fuse.Unmount(mountPoint)
-		if err != nil {
-			log.Println(err)
-		}
-    }
-	}()
+	return h.Wait()
+}
 
-	// create the filesystem structure
-	PT, err := unmarshal.Unmarshal(fileDesc, packageName, messageName, marshaled)
+// Reads the protocol buffers in r, decompressing them as they are read if
+// needed, and builds their tree. decode splits what is read into the entries of the tree. The
+// root of the tree has a .info file describing the input. The nodes of the
+// tree have the modification time of r if it is a file, and otherwise the
+// time it was read.
+func Load(r io.Reader, decode func([]byte) ([]unmarshal.Entry, error), fileDesc *google_protobuf.FileDescriptorSet, packageName string, messageName string, opts unmarshal.Options) (*pfuse.ProtoTree, error) {
+	in, err := input.NewReader(r)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	// serve
-	err = fs.Serve(c, PT)
+	p, err := ioutil.ReadAll(in)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	// check if the mount process has an error to report
-	<-c.Ready
-	if err := c.MountError; err != nil {
-		return err
+	entries, err := decode(p)
+	if err != nil {
+		return nil, err
 	}
-
-	return nil
+	PT, err := unmarshal.UnmarshalEntries(fileDesc, packageName, messageName, entries, opts)
+	if err != nil {
+		return nil, err
+	}
+	PT.Dir.Nodes = append(PT.Dir.Nodes, pfuse.TreeNode{Name: ".info", Node: &pfuse.File{Contents: in.Info()}})
+	mtime := time.Now()
+	if f, ok := r.(*os.File); ok {
+		if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+			mtime = fi.ModTime()
+		}
+	}
+	PT.SetStat("", pfuse.NewStat(mtime))
+	return PT, nil
 }
 
 // Tries to unmount the filesystem at dir.
@@ -2,10 +2,17 @@ package mount
 
 import (
 	// "os/exec"
-	// "fmt"
-	"time"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"github.com/elrichgro/protofuse/fuse"
 	"github.com/elrichgro/protofuse/test"
+	"github.com/klauspost/compress/zstd"
 )
 
 func TestInvalidMount(t *testing.T) {
@@ -16,7 +23,6 @@ func TestInvalidMount(t *testing.T) {
 }
 
 func TestUnmount(t *testing.T) {
-	c := make(chan bool)
 	var mountpoint string = "../test/mp"
 
 	buf, fDesc, packageName, messageName, err := test.GenerateFull()
@@ -24,26 +30,20 @@ func TestUnmount(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	go func() {
-		err = Mount(buf, fDesc, packageName, messageName, mountpoint)
-		if err != nil {
-			t.Fatal(err)
-		}
-		c <- true
-	}()	
-	time.Sleep(200*time.Millisecond)
+	h, err := New(context.Background(), mountpoint, Messages([][]byte{buf}), Schema{fDesc, packageName, messageName})
+	if err != nil {
+		t.Fatal(err)
+	}
 	err = Unmount(mountpoint)
 	if err != nil {
 		t.Fatal(err)
 	}
-	unmounted := <-c
-	if !unmounted {
-		t.FailNow()
+	if err := h.Wait(); err != nil {
+		t.Fatal(err)
 	}
 }
 
 func TestMountLarge(t *testing.T) {
-	c := make(chan bool)
 	var mountpoint string = "../test/mp"
 
 	buf, fDesc, packageName, messageName, err := test.GenerateLarge()
@@ -51,20 +51,170 @@ func TestMountLarge(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	go func() {
-		err = MountList(buf, fDesc, packageName, messageName, mountpoint)
+	h, err := New(context.Background(), mountpoint, Messages(buf), Schema{fDesc, packageName, messageName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Unmount(mountpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	var mountpoint string = "../test/mp"
+
+	buf, fDesc, packageName, messageName, err := test.GenerateFull()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h, err := New(ctx, mountpoint, Messages([][]byte{buf}), Schema{fDesc, packageName, messageName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-h.Ready():
+	default:
+		t.Fatal("New returned before the mount was ready")
+	}
+	// the mount is usable straight away
+	infos, err := ioutil.ReadDir(mountpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Name() != "Message_1" {
+		t.Error(fmt.Sprintf("Unexpected root entries: %v", infos))
+	}
+	cancel()
+	if err := h.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Compresses buf with gzip and with zstd.
+func compressed(t *testing.T, buf []byte) [][]byte {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(buf)
+	w.Close()
+	var zs bytes.Buffer
+	z, err := zstd.NewWriter(&zs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.Write(buf)
+	z.Close()
+	return [][]byte{gz.Bytes(), zs.Bytes()}
+}
+
+// Gets the text format of the message at the root of live called name.
+func messageText(t *testing.T, live *pfuse.Live, name string) []byte {
+	node, err := live.Lookup(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node.(*pfuse.Dir).Text()
+}
+
+func TestNewCompressed(t *testing.T) {
+	var mountpoint string = "../test/mp"
+
+	buf, fDesc, packageName, messageName, err := test.GenerateFull()
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := Schema{fDesc, packageName, messageName}
+	_, plain, err := build(Messages([][]byte{buf}), schema, config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := messageText(t, plain, "Message_1")
+
+	h, err := New(context.Background(), mountpoint, Messages(compressed(t, buf)), schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	for _, name := range []string{"Message_1", "Message_2"} {
+		got, err := ioutil.ReadFile(filepath.Join(mountpoint, name, ".textproto"))
 		if err != nil {
 			t.Fatal(err)
 		}
-		c <- true
-	}()	
-	time.Sleep(2000*time.Millisecond)
-	err = Unmount(mountpoint)
+		if !bytes.Equal(got, want) {
+			t.Error(fmt.Sprintf("%s of a compressed source holds %s, expected %s", name, got, want))
+		}
+	}
+}
+
+func TestBuildCompressed(t *testing.T) {
+	buf, fDesc, packageName, messageName, err := test.GenerateFull()
 	if err != nil {
 		t.Fatal(err)
 	}
-	unmounted := <-c
-	if !unmounted {
-		t.FailNow()
+	schema := Schema{fDesc, packageName, messageName}
+
+	_, plain, err := build(Messages([][]byte{buf}), schema, config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := messageText(t, plain, "Message_1")
+	_, live, err := build(Messages(compressed(t, buf)), schema, config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Message_1", "Message_2"} {
+		if got := messageText(t, live, name); !bytes.Equal(got, want) {
+			t.Error(fmt.Sprintf("Compressed %s was shown as %s, expected %s", name, got, want))
+		}
 	}
-}
\ No newline at end of file
+
+	// a corrupt stream is reported rather than shown as bytes
+	gz := compressed(t, buf)[0]
+	if _, _, err := build(Messages([][]byte{gz[:len(gz)/2]}), schema, config{}); err == nil {
+		t.Error("Expected truncated gzip input to be rejected")
+	}
+}
+
+func TestNewInvalidInput(t *testing.T) {
+	var mountpoint string = "../test/mp"
+
+	buf, fDesc, packageName, messageName, err := test.GenerateFull()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a truncated message fails to decode before anything is mounted
+	h, err := New(context.Background(), mountpoint, Messages([][]byte{buf[:len(buf)-1]}), Schema{fDesc, packageName, messageName})
+	if err == nil {
+		h.Close()
+		t.Fatal("Expected a truncated message to be rejected")
+	}
+	if IsStale(mountpoint) {
+		t.Error(fmt.Sprintf("Expected nothing mounted at %s", mountpoint))
+	}
+}
+
+func TestIsStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protofuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, path := range []string{dir, filepath.Join(dir, "missing")} {
+		if IsStale(path) {
+			t.Error(fmt.Sprintf("%s is not a stale mount point", path))
+		}
+		if stale, err := CleanStale(path); stale || err != nil {
+			t.Error(fmt.Sprintf("Cleaning %s: %v, %v", path, stale, err))
+		}
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Error(fmt.Sprintf("Cleaning left %s unusable: %v", dir, err))
+	}
+}
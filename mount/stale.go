@@ -0,0 +1,57 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package mount
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+// IsStale reports whether dir is a mount point left behind by a filesystem
+// whose process has died, which fails with "Transport endpoint is not
+// connected".
+func IsStale(dir string) bool {
+	_, err := os.Stat(dir)
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err == syscall.ENOTCONN
+	}
+	return false
+}
+
+// CleanStale lazily unmounts dir if it is a stale mount point, reporting
+// whether it was.
+func CleanStale(dir string) (bool, error) {
+	if !IsStale(dir) {
+		return false, nil
+	}
+	var commands [][]string
+	if runtime.GOOS == "linux" {
+		commands = [][]string{{"fusermount", "-u", "-z", dir}, {"umount", "-l", dir}}
+	} else {
+		commands = [][]string{{"umount", "-f", dir}, {"diskutil", "unmount", "force", dir}}
+	}
+	var output []byte
+	var err error
+	for _, command := range commands {
+		output, err = exec.Command(command[0], command[1:]...).CombinedOutput()
+		if err == nil {
+			return true, nil
+		}
+	}
+	return true, fmt.Errorf("Cannot unmount stale mount point %s: %v: %s", dir, err, output)
+}
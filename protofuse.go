@@ -15,55 +15,390 @@
 //  Mount marshalled protocol buffers as a FUSE filesystem.
 //  command line arguments:
 //		mount location
-//		marshalled protocol buffer
+//		marshalled protocol buffer, - for stdin, or a directory or glob of them
 //		descriptor .proto file
+//		package name
 // 		message name
+//  commands:
+//		mount            mount the protocol buffer, the default; -daemon mounts it in the background,
+//		                 -auto-mkdir creates the mount location and removes it on exit,
+//		                 -watch reloads it when the input or .proto file changes
+//		                 -source NAME=INPUT,PROTO_FILE,PACKAGE.MESSAGE (repeatable) or
+//		                 -config FILE host several sources in one mount, given only the mount
+//		                 location; .control at its root adds and removes them
+//		list             list the mounts made in the background and whether they are stale
+//		unmount [-all]   unmount the given mount points, or every mount made in the background
+//		dump             print the decoded protocol buffer instead of mounting it
+//		extract -out DIR write the tree the mount would show to DIR
+//		pack [-out FILE] encode a directory tree back into the wire format
+//  flags shared by all commands:
+//		-input-format    encoding of the input: auto, binary, text, json, hex, base64,
+//		                 base64-lines, tfrecord or recordio (not for pack)
+//		-type-map        JSON file mapping input file names to message types
+//		-bytes           rendering of bytes fields: hex, base64, hexdump, raw or auto
+//		-bytes-field     per-field bytes rendering, e.g. -bytes-field test.foo.f11=raw
+//		-bytes-views     alternate views of bytes fields shown next to them, e.g. hex,base64,raw
+//		-embed           decode a bytes field as a message, e.g. -embed test.foo.f11=test.bar
+//		-embed-config    JSON file mapping bytes fields to message types
+//		-keep-any        show google.protobuf.Any as type_url and value instead of expanding it
+//		-structural-wkt  show well-known types as directories of their fields
+//		-show-sensitive  show fields marked with the sensitive option instead of redacting them
+//		-naming          naming schemes for repeated fields and root entries: pad, subdirs
+//		-key             name the elements of a repeated message field by a field, e.g.
+//		                 -key test.foo.people=email
+//		-sensitive-option, -unit-option, -format-option
+//		                 names of the custom field options that drive presentation
 
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	"io"
+	"io/ioutil"
+	"log"
 	"os"
-	"strings"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 
+	"github.com/elrichgro/protofuse/fuse"
+	"github.com/elrichgro/protofuse/input"
 	"github.com/elrichgro/protofuse/mount"
+	"github.com/elrichgro/protofuse/registry"
+	"github.com/elrichgro/protofuse/unmarshal"
+	"github.com/elrichgro/protofuse/watch"
 	"github.com/gogo/protobuf/parser"
 	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
 )
 
 var fileDesc *google_protobuf.FileDescriptorProto
 
+// Commands other than mounting, which is done when no command is given.
+var commands = map[string]func(args []string){
+	"dump":    dumpCommand,
+	"extract": extractCommand,
+	"list":    listCommand,
+	"mount":   mountCommand,
+	"pack":    packCommand,
+	"unmount": unmountCommand,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
+	mountCommand(os.Args[1:])
+}
 
-	if len(os.Args) != 6 {
-		fmt.Printf("Usage: %s MOUNT_LOCATION, MARSHALLED_PROTOCOL_BUFFER, PROTO_FILE_LOCATION, PACKAGE_NAME, MESSAGE_NAME\n", os.Args[0])
+func mountCommand(args []string) {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	daemon := fs.Bool("daemon", false, "mount in the background, recording the mount in the registry shown by list")
+	watchInput := fs.Bool("watch", false, "reload the mount when the input or the .proto file changes")
+	autoMkdir := fs.Bool("auto-mkdir", false, "create the mount location if it does not exist, and remove it on exit")
+	var sources sourceSpecs
+	fs.Var(&sources, "source", "host a named source in its own directory, as NAME=INPUT,PROTO_FILE,PACKAGE.MESSAGE (repeatable)")
+	config := fs.String("config", "", "JSON or YAML file mapping the names of sources to host to their input, proto and message")
+	in := addInputFlags(fs)
+	render := addRenderFlags(fs)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s [mount] [-daemon] [flags] MOUNT_LOCATION, MARSHALLED_PROTOCOL_BUFFER, PROTO_FILE_LOCATION, PACKAGE_NAME, MESSAGE_NAME\n", os.Args[0])
+		fmt.Printf("       %s [mount] [-daemon] [flags] -source NAME=INPUT,PROTO_FILE,PACKAGE.MESSAGE... | -config FILE MOUNT_LOCATION\n", os.Args[0])
+		fmt.Printf("       %s dump [flags] MARSHALLED_PROTOCOL_BUFFER, PROTO_FILE_LOCATION, PACKAGE_NAME, MESSAGE_NAME\n", os.Args[0])
+		fmt.Printf("       %s extract -out DIR [flags] MARSHALLED_PROTOCOL_BUFFER, PROTO_FILE_LOCATION, PACKAGE_NAME, MESSAGE_NAME\n", os.Args[0])
+		fmt.Printf("       %s pack [-out FILE] [flags] DIR, PROTO_FILE_LOCATION, PACKAGE_NAME, MESSAGE_NAME\n", os.Args[0])
+		fmt.Printf("       %s list\n", os.Args[0])
+		fmt.Printf("       %s unmount [-all] [MOUNT_LOCATION...]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	multi := len(sources) > 0 || *config != ""
+	if (multi && fs.NArg() != 1) || (!multi && fs.NArg() != 5) {
+		fs.Usage()
 		os.Exit(-1)
 	}
 
-	mountpoint := os.Args[1]
+	// the background process parses the same arguments and does the rest
+	if *daemon && !isDaemon() {
+		if !multi && fs.Arg(1) == "-" {
+			CheckError(fmt.Errorf("Cannot read standard input in the background"))
+		}
+		CheckError(startDaemon(fs.Arg(0)))
+		return
+	}
 
-	file, err := os.Open(os.Args[2])
+	opts, err := render.options()
 	CheckError(err)
 
-	fi, err := file.Stat()
+	t := target{mountpoint: fs.Arg(0), autoMkdir: *autoMkdir}
+
+	if multi {
+		if *watchInput {
+			CheckError(fmt.Errorf("Cannot watch a mount of several sources for changes"))
+		}
+		var specs []sourceSpec
+		if *config != "" {
+			specs, err = readSourceConfig(*config)
+			CheckError(err)
+		}
+		specs = append(specs, sources...)
+		m, err := multiSource(specs, in, opts)
+		CheckError(err)
+		if isDaemon() {
+			t.entry = &registry.Entry{Source: sourceSpecs(specs).String(), Started: time.Now()}
+			t.entry.MountPoint, err = filepath.Abs(t.mountpoint)
+			CheckError(err)
+		}
+		err = serve(t, mount.Sources(m), mount.Schema{})
+		CheckError(err)
+		return
+	}
+
+	fileDescSet, err := loadSchema(fs.Arg(2))
 	CheckError(err)
+	var packageName string = fs.Arg(3)
+	var messageName string = fs.Arg(4)
+
+	schema := mount.Schema{FileDesc: fileDescSet, PackageName: packageName, MessageName: messageName}
 
-	buf := make([]byte, fi.Size())
-	_, err = io.ReadFull(file, buf)
-	file.Close()
+	// a background process records its mount in the registry
+	if isDaemon() {
+		entry := &registry.Entry{PackageName: packageName, MessageName: messageName, Started: time.Now()}
+		entry.MountPoint, err = filepath.Abs(t.mountpoint)
+		CheckError(err)
+		entry.Source, err = filepath.Abs(fs.Arg(1))
+		CheckError(err)
+		entry.Schema, err = filepath.Abs(fs.Arg(2))
+		CheckError(err)
+		t.entry = entry
+	}
+
+	if !input.IsFileSet(fs.Arg(1)) {
+		file, stream, err := openInput(fs.Arg(1))
+		CheckError(err)
 
-	filename := string(os.Args[3])
+		// a stream is mounted straight away and filled in once it has been
+		// read to EOF
+		if stream {
+			if *watchInput {
+				CheckError(fmt.Errorf("Cannot watch a stream for changes"))
+			}
+			decode, err := decoder(*in.format, fileDescSet, packageName, messageName)
+			CheckError(err)
+			err = serve(t, mount.Stream(file, decode), schema, mount.WithOptions(opts))
+			CheckError(err)
+			return
+		}
+		file.Close()
+	}
 
-	fileDescSet, err := parser.ParseFile(filename, filename[:strings.LastIndex(filename, "/")])
+	// a directory, glob or regular file is read up front, and read again
+	// along with the schema when they change if -watch is given
+	load := func() (*pfuse.ProtoTree, error) {
+		return loadTree(fs.Arg(1), fs.Arg(2), packageName, messageName, in, opts)
+	}
+	if *watchInput {
+		t.watch = []string{fs.Arg(1), fs.Arg(2)}
+		t.reload = load
+	}
+
+	PT, err := load()
 	CheckError(err)
-	var packageName string = os.Args[4]
-	var messageName string = os.Args[5]
 
-	err = mount.Mount(buf, fileDescSet, packageName, messageName, mountpoint)
+	err = serve(t, mount.Tree(PT), schema)
 	CheckError(err)
 }
 
+// target is where the mount command mounts, and what it does around the
+// mount.
+type target struct {
+	mountpoint string
+	// autoMkdir creates the mount point if it does not exist, removing it
+	// once the filesystem is unmounted.
+	autoMkdir bool
+	// entry, if not nil, is recorded in the registry while the mount is up.
+	entry *registry.Entry
+	// watch lists the files whose changes make reload rebuild the tree
+	// shown by the mount.
+	watch  []string
+	reload func() (*pfuse.ProtoTree, error)
+}
+
+// Mounts source at t until the filesystem is unmounted, unmounting it on an
+// interrupt, SIGTERM or SIGHUP.
+func serve(t target, source mount.Source, schema mount.Schema, opts ...mount.Option) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// signals are handled from the start, so that one arriving while the
+	// mount is set up stops it and what was created for it is removed
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sig)
+	mounted := make(chan *mount.Handle, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go handleSignals(sig, cancel, mounted, stop)
+
+	if t.autoMkdir {
+		if _, err := os.Stat(t.mountpoint); os.IsNotExist(err) {
+			if err := os.MkdirAll(t.mountpoint, 0755); err != nil {
+				return err
+			}
+			defer os.Remove(t.mountpoint)
+		}
+	}
+
+	h, err := mount.New(ctx, t.mountpoint, source, schema, opts...)
+	if err == context.Canceled {
+		// a signal stopped the mount before it was up
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	mounted <- h
+	if t.entry != nil {
+		unregister, err := registerDaemon(*t.entry)
+		if err != nil {
+			h.Close()
+			return err
+		}
+		defer unregister()
+	}
+	if len(t.watch) > 0 {
+		w, err := watch.New(t.watch)
+		if err != nil {
+			h.Close()
+			return err
+		}
+		defer w.Close()
+		go func() {
+			for range w.Changes() {
+				PT, err := t.reload()
+				if err == nil {
+					err = h.Update(PT)
+				}
+				if err != nil {
+					log.Printf("reloading, keeping the previous tree: %v", err)
+					continue
+				}
+				log.Printf("reloaded %s", t.mountpoint)
+			}
+		}()
+	}
+
+	return h.Wait()
+}
+
+// Handles the signals serve unmounts on. The first cancels the mount if it
+// is still being set up, and each signal unmounts the handle sent on
+// mounted, as an unmount fails while the mount point is busy. It returns
+// once that filesystem has stopped being served, or stop is closed.
+func handleSignals(sig <-chan os.Signal, cancel context.CancelFunc, mounted <-chan *mount.Handle, stop <-chan struct{}) {
+	var h *mount.Handle
+	var done <-chan struct{}
+	for {
+		select {
+		case s := <-sig:
+			log.Printf("captured %v, unmounting filesystem", s)
+			cancel()
+			if h == nil {
+				continue
+			}
+			if err := h.Close(); err != nil {
+				log.Printf("unmounting %s: %v", h.MountPoint(), err)
+			}
+		case h = <-mounted:
+			done = h.Done()
+		case <-done:
+			return
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Gets the function converting an input in format to marshalled messages.
+func decoder(format string, fileDescSet *google_protobuf.FileDescriptorSet, packageName string, messageName string) (func([]byte) ([]unmarshal.Entry, error), error) {
+	f, err := input.ParseFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	return func(p []byte) ([]unmarshal.Entry, error) {
+		return input.Decode(p, f, fileDescSet, packageName, messageName)
+	}, nil
+}
+
+// Reads the messages in filename, converting them from the input format
+// to the wire format. filename may also be a directory or glob pattern, in
+// which case the messages are named after the files.
+func readMessages(filename string, in *inputFlags, fileDescSet *google_protobuf.FileDescriptorSet, packageName string, messageName string) ([]unmarshal.Entry, error) {
+	if input.IsFileSet(filename) {
+		f, err := input.ParseFormat(*in.format)
+		if err != nil {
+			return nil, err
+		}
+		types, err := in.types()
+		if err != nil {
+			return nil, err
+		}
+		return input.ReadFiles(filename, f, types, fileDescSet, packageName, messageName)
+	}
+	decode, err := decoder(*in.format, fileDescSet, packageName, messageName)
+	if err != nil {
+		return nil, err
+	}
+	p, err := readInput(filename)
+	if err != nil {
+		return nil, err
+	}
+	return decode(p)
+}
+
+// Opens filename, or stdin if filename is "-". A stream is an input that
+// may still be arriving, such as a pipe, rather than a regular file.
+func openInput(filename string) (file *os.File, stream bool, err error) {
+	if filename == "-" {
+		return os.Stdin, true, nil
+	}
+	file, err = os.Open(filename)
+	if err != nil {
+		return nil, false, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, false, err
+	}
+	return file, !fi.Mode().IsRegular(), nil
+}
+
+// Reads the whole of filename, or of stdin if filename is "-",
+// decompressing it if needed.
+func readInput(filename string) ([]byte, error) {
+	file, _, err := openInput(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	in, err := input.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(in)
+}
+
+// Parses the .proto file filename, resolving imports relative to its directory.
+func loadSchema(filename string) (*google_protobuf.FileDescriptorSet, error) {
+	return parser.ParseFile(filename, filepath.Dir(filename))
+}
+
 func CheckError(err error) {
 	if err != nil {
 		fmt.Println(err.Error())
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/elrichgro/protofuse/mount"
+	"github.com/elrichgro/protofuse/test"
+)
+
+func TestServeAutoMkdir(t *testing.T) {
+	buf, fDesc, packageName, messageName, err := test.GenerateFull()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "protofuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a truncated message fails to mount, after the mount point is made
+	source := mount.Messages([][]byte{buf[:len(buf)-1]})
+	schema := mount.Schema{FileDesc: fDesc, PackageName: packageName, MessageName: messageName}
+
+	created := filepath.Join(dir, "created")
+	if err := serve(target{mountpoint: created, autoMkdir: true}, source, schema); err == nil {
+		t.Fatal("Expected a truncated message to fail to mount")
+	}
+	if _, err := os.Stat(created); !os.IsNotExist(err) {
+		t.Error(fmt.Sprintf("Expected %s to be removed, got %v", created, err))
+	}
+
+	existing := filepath.Join(dir, "existing")
+	if err := os.Mkdir(existing, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := serve(target{mountpoint: existing, autoMkdir: true}, source, schema); err == nil {
+		t.Fatal("Expected a truncated message to fail to mount")
+	}
+	if fi, err := os.Stat(existing); err != nil || !fi.IsDir() {
+		t.Error(fmt.Sprintf("Expected %s to be kept, got %v", existing, err))
+	}
+}
+
+func TestHandleSignals(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	stop := make(chan struct{})
+	returned := make(chan struct{})
+	go func() {
+		handleSignals(sig, cancel, make(chan *mount.Handle), stop)
+		close(returned)
+	}()
+
+	// a signal before anything is mounted stops the mount being set up,
+	// and the signals after it are still handled
+	for i := 0; i < 3; i++ {
+		sig <- syscall.SIGTERM
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Expected a signal to cancel the mount")
+	}
+
+	close(stop)
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Error("Expected signals to stop being handled once serve returns")
+	}
+}
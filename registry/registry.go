@@ -0,0 +1,143 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+// The registry package records the mounts made by protofuse processes
+// running in the background, in a per-user state directory.
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Entry describes a mount served by a background process.
+type Entry struct {
+	PID         int
+	Source      string
+	Schema      string
+	PackageName string
+	MessageName string
+	MountPoint  string
+	Started     time.Time
+}
+
+// Gets the directory the registry is kept in: $XDG_STATE_HOME/protofuse,
+// or ~/.local/state/protofuse.
+func Dir() (string, error) {
+	if state := os.Getenv("XDG_STATE_HOME"); state != "" {
+		return filepath.Join(state, "protofuse"), nil
+	}
+	home := os.Getenv("HOME")
+	if home == "" {
+		return "", fmt.Errorf("Cannot find the state directory: HOME is not set")
+	}
+	return filepath.Join(home, ".local", "state", "protofuse"), nil
+}
+
+// Gets the file recording the entry of the process pid.
+func entryFile(dir string, pid int) string {
+	return filepath.Join(dir, strconv.Itoa(pid)+".json")
+}
+
+// Add records e, replacing any entry with the same PID.
+func Add(e Entry) error {
+	dir, err := Dir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write then rename, so List never sees a partly written entry
+	file := entryFile(dir, e.PID)
+	if err := ioutil.WriteFile(file+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// Remove deletes the entry of the process pid, if there is one.
+func Remove(pid int) error {
+	dir, err := Dir()
+	if err != nil {
+		return err
+	}
+	err = os.Remove(entryFile(dir, pid))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// List gets the recorded entries, ordered by mount point.
+func List() ([]Entry, error) {
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var e Entry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return nil, fmt.Errorf("%s: %v", info.Name(), err)
+		}
+		entries = append(entries, e)
+	}
+	sort.Sort(byMountPoint(entries))
+	return entries, nil
+}
+
+// Alive reports whether the process that made the entry is still running.
+// An entry whose process has died is stale, and its mount point is likely
+// left disconnected.
+func (e Entry) Alive() bool {
+	if e.PID <= 0 {
+		return false
+	}
+	err := syscall.Kill(e.PID, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+type byMountPoint []Entry
+
+func (b byMountPoint) Len() int           { return len(b) }
+func (b byMountPoint) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byMountPoint) Less(i, j int) bool { return b[i].MountPoint < b[j].MountPoint }
@@ -0,0 +1,60 @@
+package registry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protofuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("XDG_STATE_HOME", dir)
+
+	entries, err := List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Error(fmt.Sprintf("Expected no entries, got %v", entries))
+	}
+
+	// the entry of this process is alive, that of a process that cannot
+	// exist is stale
+	alive := Entry{PID: os.Getpid(), MountPoint: "/b", Started: time.Now()}
+	stale := Entry{PID: 1 << 30, MountPoint: "/a"}
+	for _, e := range []Entry{alive, stale} {
+		if err := Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err = List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].MountPoint != "/a" || entries[1].MountPoint != "/b" {
+		t.Fatal(fmt.Sprintf("Unexpected entries: %v", entries))
+	}
+	if entries[0].Alive() || !entries[1].Alive() {
+		t.Error("Expected only the entry of this process to be alive")
+	}
+
+	if err := Remove(stale.PID); err != nil {
+		t.Fatal(err)
+	}
+	if err := Remove(stale.PID); err != nil {
+		t.Error(fmt.Sprintf("Removing a missing entry: %v", err))
+	}
+	entries, err = List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].PID != alive.PID {
+		t.Error(fmt.Sprintf("Unexpected entries after removal: %v", entries))
+	}
+}
@@ -0,0 +1,241 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/elrichgro/protofuse/fuse"
+	"github.com/elrichgro/protofuse/input"
+	"github.com/elrichgro/protofuse/mount"
+	"github.com/elrichgro/protofuse/unmarshal"
+	"gopkg.in/yaml.v2"
+)
+
+// sourceSpec is one of the named sources of a mount hosting several, given
+// as NAME=INPUT,PROTO_FILE,PACKAGE.MESSAGE.
+type sourceSpec struct {
+	Name    string `json:"-" yaml:"-"`
+	Input   string `json:"input" yaml:"input"`
+	Proto   string `json:"proto" yaml:"proto"`
+	Message string `json:"message" yaml:"message"`
+}
+
+func parseSourceSpec(value string) (sourceSpec, error) {
+	var s sourceSpec
+	i := strings.Index(value, "=")
+	parts := strings.Split(value[i+1:], ",")
+	if i < 0 || len(parts) != 3 {
+		return s, fmt.Errorf("Expected NAME=INPUT,PROTO_FILE,PACKAGE.MESSAGE, got %s", value)
+	}
+	s = sourceSpec{Name: value[:i], Input: parts[0], Proto: parts[1], Message: parts[2]}
+	return s, s.check()
+}
+
+// Checks that every part of s is given.
+func (s sourceSpec) check() error {
+	if s.Name == "" || s.Input == "" || s.Proto == "" || !strings.Contains(s.Message, ".") {
+		return fmt.Errorf("Incomplete source %s: expected a name, input, .proto file and PACKAGE.MESSAGE", s)
+	}
+	return nil
+}
+
+func (s sourceSpec) String() string {
+	return s.Name + "=" + s.Input + "," + s.Proto + "," + s.Message
+}
+
+// Makes the input and .proto paths of s absolute, taking relative paths
+// from dir, so that they do not depend on the working directory of the
+// mount process.
+func (s *sourceSpec) resolve(dir string) {
+	if !filepath.IsAbs(s.Input) {
+		s.Input = filepath.Join(dir, s.Input)
+	}
+	if !filepath.IsAbs(s.Proto) {
+		s.Proto = filepath.Join(dir, s.Proto)
+	}
+}
+
+// Gets the package and message names of the type of s.
+func (s sourceSpec) messageType() (string, string) {
+	i := strings.LastIndex(s.Message, ".")
+	return s.Message[:i], s.Message[i+1:]
+}
+
+// sourceSpecs collects repeated -source flags.
+type sourceSpecs []sourceSpec
+
+func (s sourceSpecs) String() string {
+	var specs []string
+	for _, spec := range s {
+		specs = append(specs, spec.String())
+	}
+	return strings.Join(specs, " ")
+}
+
+// Set adds a source, with relative paths taken from the working directory.
+func (s *sourceSpecs) Set(value string) error {
+	spec, err := parseSourceSpec(value)
+	if err != nil {
+		return err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	spec.resolve(wd)
+	*s = append(*s, spec)
+	return nil
+}
+
+// Reads the sources of a mount config: a JSON object, or a YAML mapping if
+// the file ends in .yaml or .yml, mapping the name of each source to its
+// input, proto and message, e.g.
+// {"config": {"input": "config.pb", "proto": "config.proto", "message": "app.Config"}}.
+// Relative paths are taken from the directory of the config.
+func readSourceConfig(filename string) ([]sourceSpec, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var config map[string]sourceSpec
+	switch filepath.Ext(filename) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, &config)
+	default:
+		err = json.Unmarshal(data, &config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	var specs []sourceSpec
+	for name, spec := range config {
+		spec.Name = name
+		if err := spec.check(); err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		spec.resolve(filepath.Dir(filename))
+		specs = append(specs, spec)
+	}
+	sort.Sort(byName(specs))
+	return specs, nil
+}
+
+type byName []sourceSpec
+
+func (b byName) Len() int           { return len(b) }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byName) Less(i, j int) bool { return b[i].Name < b[j].Name }
+
+// Reads and decodes a directory, glob or regular file input against the
+// schema in protoFile.
+func loadTree(filename string, protoFile string, packageName string, messageName string, in *inputFlags, opts unmarshal.Options) (*pfuse.ProtoTree, error) {
+	fileDescSet, err := loadSchema(protoFile)
+	if err != nil {
+		return nil, err
+	}
+	if input.IsFileSet(filename) {
+		entries, err := readMessages(filename, in, fileDescSet, packageName, messageName)
+		if err != nil {
+			return nil, err
+		}
+		PT, err := unmarshal.UnmarshalEntries(fileDescSet, packageName, messageName, entries, opts)
+		if err != nil {
+			return nil, err
+		}
+		PT.SetStat("", pfuse.NewStat(newestModTime(filename)))
+		return PT, nil
+	}
+	decode, err := decoder(*in.format, fileDescSet, packageName, messageName)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return mount.Load(file, decode, fileDescSet, packageName, messageName, opts)
+}
+
+// Gets the latest modification time of the files of a directory or glob
+// input, or the current time if it has none.
+func newestModTime(path string) time.Time {
+	var files []string
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		files, _ = filepath.Glob(filepath.Join(path, "*"))
+	} else {
+		files, _ = filepath.Glob(path)
+	}
+	var newest time.Time
+	for _, file := range files {
+		if fi, err := os.Stat(file); err == nil && fi.Mode().IsRegular() && fi.ModTime().After(newest) {
+			newest = fi.ModTime()
+		}
+	}
+	if newest.IsZero() {
+		return time.Now()
+	}
+	return newest
+}
+
+// Builds a mount hosting each of specs in a directory named after it.
+// Writing "add NAME=INPUT,PROTO_FILE,PACKAGE.MESSAGE" or "remove NAME" to
+// its .control file adds or removes sources while it is mounted, with
+// relative paths taken from the current working directory.
+func multiSource(specs []sourceSpec, in *inputFlags, opts unmarshal.Options) (*pfuse.Multi, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	var m *pfuse.Multi
+	add := func(spec sourceSpec) error {
+		packageName, messageName := spec.messageType()
+		PT, err := loadTree(spec.Input, spec.Proto, packageName, messageName, in, opts)
+		if err != nil {
+			return fmt.Errorf("%s: %v", spec.Name, err)
+		}
+		return m.Add(spec.Name, spec.String(), PT)
+	}
+	m = pfuse.NewMulti(func(command string) error {
+		fields := strings.Fields(command)
+		switch {
+		case len(fields) == 2 && fields[0] == "add":
+			spec, err := parseSourceSpec(fields[1])
+			if err != nil {
+				return err
+			}
+			spec.resolve(wd)
+			return add(spec)
+		case len(fields) == 2 && fields[0] == "remove":
+			return m.Remove(fields[1])
+		}
+		return fmt.Errorf("Unknown command %q, expected add NAME=INPUT,PROTO_FILE,PACKAGE.MESSAGE or remove NAME", command)
+	})
+
+	for _, spec := range specs {
+		if err := add(spec); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSourceSpecsSet(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var specs sourceSpecs
+	if err := specs.Set("a=in/a.pb,/src/api.proto,api.Request"); err != nil {
+		t.Fatal(err)
+	}
+	expected := sourceSpec{Name: "a", Input: filepath.Join(wd, "in/a.pb"), Proto: "/src/api.proto", Message: "api.Request"}
+	if len(specs) != 1 || specs[0] != expected {
+		t.Error(fmt.Sprintf("Expected %v, got %v", expected, specs))
+	}
+	if packageName, messageName := specs[0].messageType(); packageName != "api" || messageName != "Request" {
+		t.Error(fmt.Sprintf("Expected api.Request, got %s.%s", packageName, messageName))
+	}
+
+	for _, value := range []string{"a.pb,api.proto,api.Request", "a=a.pb,api.proto", "a=a.pb,api.proto,Request", "=a.pb,api.proto,api.Request"} {
+		if err := specs.Set(value); err == nil {
+			t.Error(fmt.Sprintf("Expected %q to be rejected", value))
+		}
+	}
+	if len(specs) != 1 {
+		t.Error(fmt.Sprintf("Rejected sources were added: %v", specs))
+	}
+}
+
+func TestReadSourceConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protofuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	expected := []sourceSpec{
+		{Name: "a", Input: filepath.Join(dir, "a.pb"), Proto: "/src/api.proto", Message: "api.Request"},
+		{Name: "b", Input: "/data/b", Proto: filepath.Join(dir, "protos/config.proto"), Message: "app.Config"},
+	}
+	configs := map[string]string{
+		"sources.json": `{"b": {"input": "/data/b", "proto": "protos/config.proto", "message": "app.Config"},
+			"a": {"input": "a.pb", "proto": "/src/api.proto", "message": "api.Request"}}`,
+		"sources.yaml": "b:\n  input: /data/b\n  proto: protos/config.proto\n  message: app.Config\n" +
+			"a:\n  input: a.pb\n  proto: /src/api.proto\n  message: api.Request\n",
+	}
+	for name, contents := range configs {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		specs, err := readSourceConfig(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(specs, expected) {
+			t.Error(fmt.Sprintf("%s: expected %v, got %v", name, expected, specs))
+		}
+	}
+
+	invalid := map[string]string{
+		"incomplete.json": `{"a": {"input": "a.pb", "message": "api.Request"}}`,
+		"malformed.json":  `{"a": `,
+		"unknown.yml":     "a:\n  input: a.pb\n  proto: api.proto\n  message: api.Request\n  schema: api.proto\n",
+	}
+	for name, contents := range invalid {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readSourceConfig(filename); err == nil {
+			t.Error(fmt.Sprintf("Expected %s to be rejected", name))
+		}
+	}
+}
@@ -110,4 +110,56 @@ func getFileDescriptorSet(filename string) (*google_protobuf.FileDescriptorSet,
 	}
 
 	return fDesc, nil
-}
\ No newline at end of file
+}
+// Name of the file declaring the custom field options set by Annotate.
+const optionsFile = "options.proto"
+
+// Annotate sets the custom field option called option on the field of foo
+// called fieldName, declaring the option in package opts of fDesc if it is
+// not yet declared. value is a bool or a string.
+func Annotate(fDesc *google_protobuf.FileDescriptorSet, fieldName string, option string, value interface{}) {
+	var file *google_protobuf.FileDescriptorProto
+	for _, f := range fDesc.GetFile() {
+		if f.GetName() == optionsFile {
+			file = f
+		}
+	}
+	if file == nil {
+		file = &google_protobuf.FileDescriptorProto{Name: proto.String(optionsFile), Package: proto.String("opts")}
+		fDesc.File = append(fDesc.File, file)
+	}
+	var number int32
+	for _, ext := range file.GetExtension() {
+		if ext.GetName() == option {
+			number = ext.GetNumber()
+		}
+	}
+	var enc []byte
+	typ := google_protobuf.FieldDescriptorProto_TYPE_STRING
+	if _, ok := value.(bool); ok {
+		typ = google_protobuf.FieldDescriptorProto_TYPE_BOOL
+	}
+	if number == 0 {
+		number = int32(50000 + len(file.GetExtension()))
+		file.Extension = append(file.Extension, &google_protobuf.FieldDescriptorProto{Name: proto.String(option), Number: proto.Int32(number),
+			Label: google_protobuf.FieldDescriptorProto_LABEL_OPTIONAL.Enum(), Type: typ.Enum(), Extendee: proto.String(".google.protobuf.FieldOptions")})
+	}
+	switch v := value.(type) {
+	case bool:
+		enc = append(proto.EncodeVarint(uint64(number)<<3), 0)
+		if v {
+			enc[len(enc)-1] = 1
+		}
+	case string:
+		enc = append(proto.EncodeVarint(uint64(number)<<3|2), proto.EncodeVarint(uint64(len(v)))...)
+		enc = append(enc, v...)
+	}
+	for _, field := range fDesc.GetMessage("test", "foo").GetField() {
+		if field.GetName() == fieldName {
+			if field.Options == nil {
+				field.Options = &google_protobuf.FieldOptions{}
+			}
+			field.Options.ExtensionMap()[number] = proto.NewExtension(enc)
+		}
+	}
+}
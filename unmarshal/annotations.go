@@ -0,0 +1,217 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package unmarshal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/elrichgro/protofuse/fuse"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+)
+
+// Annotations names the custom field options, i.e. extensions of
+// google.protobuf.FieldOptions, that drive how a field is presented.
+// A name is either fully qualified, e.g. "acme.sensitive", or a bare name
+// matching an extension of that name in any package. Empty names are ignored.
+type Annotations struct {
+	// A bool option marking fields whose values are redacted unless
+	// Options.ShowSensitive is set.
+	Sensitive string
+	// A string option holding a unit appended to the value of a numeric
+	// field, e.g. "ms".
+	Unit string
+	// A string option choosing the rendering of the field's value. Bytes
+	// fields accept the names understood by ParseBytesFormat, integer fields
+	// accept "hex", "oct" and "bin", and numeric fields accept a fmt verb
+	// such as "%.2f".
+	Format string
+}
+
+// The custom options set on a field.
+type annotation struct {
+	sensitive bool
+	unit      string
+	format    string
+}
+
+// Resolves the option names in a against the extensions of
+// google.protobuf.FieldOptions in the descriptors of dec, and reads the
+// custom options of every field.
+func (dec *Decoder) resolveAnnotations(a Annotations) {
+	dec.sensitiveOption = dec.findFieldOption(a.Sensitive)
+	dec.unitOption = dec.findFieldOption(a.Unit)
+	dec.formatOption = dec.findFieldOption(a.Format)
+	dec.annotations = make(map[*google_protobuf.FieldDescriptorProto]*annotation)
+	for field := range dec.fieldNames {
+		dec.annotations[field] = dec.readAnnotation(field)
+	}
+}
+
+func (dec *Decoder) findFieldOption(name string) int32 {
+	if name == "" {
+		return 0
+	}
+	name = strings.TrimPrefix(name, ".")
+	for field, fullName := range dec.fieldNames {
+		if field.GetExtendee() != ".google.protobuf.FieldOptions" {
+			continue
+		}
+		if fullName == name || strings.HasSuffix(fullName, "."+name) {
+			return field.GetNumber()
+		}
+	}
+	return 0
+}
+
+// Gets the custom options set on field.
+func (dec *Decoder) getAnnotation(field *google_protobuf.FieldDescriptorProto) *annotation {
+	if a, ok := dec.annotations[field]; ok {
+		return a
+	}
+	// fields made up while decoding, such as the @type of an Any
+	return dec.readAnnotation(field)
+}
+
+// Reads the custom options set on field from its descriptor.
+func (dec *Decoder) readAnnotation(field *google_protobuf.FieldDescriptorProto) *annotation {
+	a := &annotation{}
+	if field.GetOptions() != nil {
+		ext := field.GetOptions().ExtensionMap()
+		if v, ok := fieldOption(ext, dec.sensitiveOption); ok {
+			a.sensitive = v.varint != 0
+		}
+		if v, ok := fieldOption(ext, dec.unitOption); ok {
+			a.unit = string(v.bytes)
+		}
+		if v, ok := fieldOption(ext, dec.formatOption); ok {
+			a.format = string(v.bytes)
+		}
+	}
+	return a
+}
+
+// Reads the value of the custom option number from ext.
+func fieldOption(ext map[int32]proto.Extension, number int32) (rawField, bool) {
+	if _, ok := ext[number]; number == 0 || !ok {
+		return rawField{}, false
+	}
+	enc, err := proto.GetRawExtension(ext, number)
+	if err != nil {
+		return rawField{}, false
+	}
+	fields, err := readFields(enc)
+	if err != nil || len(fields) == 0 {
+		return rawField{}, false
+	}
+	return fields[len(fields)-1], true
+}
+
+// IsRedacted reports whether the values of field are redacted under the
+// options of dec.
+func (dec *Decoder) IsRedacted(field *google_protobuf.FieldDescriptorProto) bool {
+	return dec.getAnnotation(field).sensitive && !dec.options.ShowSensitive
+}
+
+// IsRounded reports whether the values of field are shown rounded by its
+// format option, so that its files cannot be packed again.
+func (dec *Decoder) IsRounded(field *google_protobuf.FieldDescriptorProto) bool {
+	switch field.GetType() {
+	case google_protobuf.FieldDescriptorProto_TYPE_DOUBLE, google_protobuf.FieldDescriptorProto_TYPE_FLOAT:
+		return strings.HasPrefix(dec.getAnnotation(field).format, "%")
+	}
+	return false
+}
+
+// Applies the custom options of field to the decoded node t, and reports
+// whether t is or contains a redacted field.
+func (dec *Decoder) annotate(field *google_protobuf.FieldDescriptorProto, t *pfuse.TreeNode) bool {
+	a := dec.getAnnotation(field)
+	if dec.IsRedacted(field) {
+		t.Node = &pfuse.File{Contents: pfuse.Redacted}
+		return true
+	}
+	file, ok := t.Node.(*pfuse.File)
+	if !ok {
+		dir, ok := t.Node.(*pfuse.Dir)
+		return ok && dir.Redacted
+	}
+	decoded := file.Contents
+	if a.format != "" && field.GetType() != google_protobuf.FieldDescriptorProto_TYPE_BYTES {
+		file.Contents = formatNumber(field, file.Contents, a.format)
+	}
+	if a.unit != "" && isNumeric(field) {
+		file.Contents += " " + a.unit
+	}
+	if file.Contents != decoded {
+		file.Value = decoded
+	}
+	return false
+}
+
+// Reports whether field holds a number, which units apply to.
+func isNumeric(field *google_protobuf.FieldDescriptorProto) bool {
+	switch field.GetType() {
+	case google_protobuf.FieldDescriptorProto_TYPE_BOOL, google_protobuf.FieldDescriptorProto_TYPE_ENUM,
+		google_protobuf.FieldDescriptorProto_TYPE_STRING, google_protobuf.FieldDescriptorProto_TYPE_BYTES,
+		google_protobuf.FieldDescriptorProto_TYPE_MESSAGE, google_protobuf.FieldDescriptorProto_TYPE_GROUP:
+		return false
+	}
+	return true
+}
+
+// Re-renders the decimal contents of a numeric field in format, leaving
+// contents unchanged if the format does not apply to the field.
+func formatNumber(field *google_protobuf.FieldDescriptorProto, contents string, format string) string {
+	switch field.GetType() {
+	case google_protobuf.FieldDescriptorProto_TYPE_DOUBLE, google_protobuf.FieldDescriptorProto_TYPE_FLOAT:
+		x, err := strconv.ParseFloat(contents, 64)
+		if err != nil || !strings.HasPrefix(format, "%") {
+			return contents
+		}
+		return fmt.Sprintf(format, x)
+	case google_protobuf.FieldDescriptorProto_TYPE_BOOL, google_protobuf.FieldDescriptorProto_TYPE_ENUM,
+		google_protobuf.FieldDescriptorProto_TYPE_STRING, google_protobuf.FieldDescriptorProto_TYPE_MESSAGE:
+		return contents
+	}
+	var x interface{}
+	if strings.HasPrefix(contents, "-") {
+		v, err := strconv.ParseInt(contents, 10, 64)
+		if err != nil {
+			return contents
+		}
+		x = v
+	} else {
+		v, err := strconv.ParseUint(contents, 10, 64)
+		if err != nil {
+			return contents
+		}
+		x = v
+	}
+	switch format {
+	case "hex":
+		return fmt.Sprintf("%#x", x)
+	case "oct":
+		return fmt.Sprintf("%#o", x)
+	case "bin":
+		return fmt.Sprintf("0b%b", x)
+	}
+	if strings.HasPrefix(format, "%") {
+		return fmt.Sprintf(format, x)
+	}
+	return contents
+}
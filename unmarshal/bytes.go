@@ -0,0 +1,226 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package unmarshal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/elrichgro/protofuse/fuse"
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+)
+
+// BytesFormat selects how the contents of a bytes field are rendered.
+type BytesFormat int
+
+const (
+	// Hex encodes the bytes as a single line of lowercase hex.
+	BytesHex BytesFormat = iota
+	// Standard base64 encoding.
+	BytesBase64
+	// An xxd style hexdump with offsets and an ASCII gutter.
+	BytesHexdump
+	// The bytes unchanged, so that tools like file(1) work on them.
+	BytesRaw
+	// Printable UTF-8 is shown as text, anything else as hex.
+	BytesAuto
+)
+
+var bytesFormatNames = map[string]BytesFormat{
+	"hex":     BytesHex,
+	"base64":  BytesBase64,
+	"b64":     BytesBase64,
+	"hexdump": BytesHexdump,
+	"xxd":     BytesHexdump,
+	"raw":     BytesRaw,
+	"auto":    BytesAuto,
+}
+
+// ParseBytesFormat returns the BytesFormat called name.
+func ParseBytesFormat(name string) (BytesFormat, error) {
+	f, ok := bytesFormatNames[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("Unknown bytes format: %s", name)
+	}
+	return f, nil
+}
+
+func (f BytesFormat) String() string {
+	switch f {
+	case BytesHex:
+		return "hex"
+	case BytesBase64:
+		return "base64"
+	case BytesHexdump:
+		return "hexdump"
+	case BytesRaw:
+		return "raw"
+	case BytesAuto:
+		return "auto"
+	}
+	return fmt.Sprintf("BytesFormat(%d)", int(f))
+}
+
+// Extension is the file name suffix used when f is shown as an alternate view.
+func (f BytesFormat) Extension() string {
+	switch f {
+	case BytesBase64:
+		return ".b64"
+	case BytesHexdump:
+		return ".hexdump"
+	case BytesRaw:
+		return ".raw"
+	case BytesAuto:
+		return ".txt"
+	}
+	return ".hex"
+}
+
+// Renders p in format f.
+func formatBytes(p []byte, f BytesFormat) string {
+	switch f {
+	case BytesBase64:
+		return base64.StdEncoding.EncodeToString(p)
+	case BytesHexdump:
+		return hexdump(p)
+	case BytesRaw:
+		return string(p)
+	case BytesAuto:
+		if isPrintable(p) {
+			return string(p)
+		}
+	}
+	return hex.EncodeToString(p)
+}
+
+// ParseBytes is the inverse of rendering bytes in format f. Text rendered by
+// BytesAuto cannot be read back, as printable bytes that are valid hex would
+// be taken for hex.
+func ParseBytes(s string, f BytesFormat) ([]byte, error) {
+	switch f {
+	case BytesBase64:
+		return base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	case BytesHexdump:
+		return parseHexdump(s)
+	case BytesRaw:
+		return []byte(s), nil
+	case BytesAuto:
+		return nil, fmt.Errorf("Bytes rendered as auto cannot be read back, use another format or a raw view")
+	}
+	return hex.DecodeString(strings.TrimSpace(s))
+}
+
+// Reads the bytes back from the output of hexdump.
+func parseHexdump(s string) ([]byte, error) {
+	var p []byte
+	for _, line := range strings.Split(s, "\n") {
+		if line == "" {
+			continue
+		}
+		i := strings.Index(line, ": ")
+		if i < 0 || len(line) < i+2+40 {
+			return nil, fmt.Errorf("Invalid hexdump line: %s", line)
+		}
+		b, err := hex.DecodeString(strings.Replace(line[i+2:i+2+40], " ", "", -1))
+		if err != nil {
+			return nil, err
+		}
+		p = append(p, b...)
+	}
+	return p, nil
+}
+
+// Produces the same layout as xxd: 16 bytes per line in groups of two.
+func hexdump(p []byte) string {
+	var b bytes.Buffer
+	for off := 0; off < len(p); off += 16 {
+		end := off + 16
+		if end > len(p) {
+			end = len(p)
+		}
+		line := p[off:end]
+		fmt.Fprintf(&b, "%08x: ", off)
+		for i := 0; i < 16; i++ {
+			if i < len(line) {
+				fmt.Fprintf(&b, "%02x", line[i])
+			} else {
+				b.WriteString("  ")
+			}
+			if i%2 == 1 {
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteByte(' ')
+		for _, c := range line {
+			if c >= 0x20 && c < 0x7f {
+				b.WriteByte(c)
+			} else {
+				b.WriteByte('.')
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+func isPrintable(p []byte) bool {
+	if !utf8.Valid(p) {
+		return false
+	}
+	for _, r := range string(p) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// FieldBytesFormat gets the format bytes field is rendered in under the
+// options of dec: its -bytes-field format, else its format option, else the
+// default.
+func (dec *Decoder) FieldBytesFormat(field *google_protobuf.FieldDescriptorProto) BytesFormat {
+	if f, ok := dec.options.FieldBytes[dec.fieldNames[field]]; ok {
+		return f
+	}
+	if a := dec.getAnnotation(field); a.format != "" {
+		if f, err := ParseBytesFormat(a.format); err == nil {
+			return f
+		}
+	}
+	return dec.options.Bytes
+}
+
+// Creates the alternate views of a decoded bytes field as siblings of t.
+func (dec *Decoder) bytesViews(t *pfuse.TreeNode) []pfuse.TreeNode {
+	// redacted fields have no raw value to show
+	file, ok := t.Node.(*pfuse.File)
+	if !ok || file.Raw == nil {
+		return nil
+	}
+	var views []pfuse.TreeNode
+	for _, f := range dec.options.BytesViews {
+		v := *t
+		v.Name = t.Name + f.Extension()
+		v.View = true
+		v.Node = &pfuse.File{Contents: formatBytes(file.Raw, f), Raw: file.Raw}
+		views = append(views, v)
+	}
+	return views
+}
@@ -0,0 +1,102 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package unmarshal
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/elrichgro/protofuse/fuse"
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+)
+
+// Field numbers of the descriptor fields that make up the paths of
+// SourceCodeInfo locations.
+const (
+	fileMessageTypePath  = 4
+	fileExtensionPath    = 7
+	messageFieldPath     = 2
+	messageNestedPath    = 3
+	messageExtensionPath = 6
+)
+
+// Sets the Meta of every node of PT decoded from a field, so that the
+// extended attributes of the node describe its field. Comments are only
+// known if the descriptors were built with source info.
+func (dec *Decoder) describe(PT *pfuse.ProtoTree) {
+	metas := make(map[*google_protobuf.FieldDescriptorProto]*pfuse.FieldMeta)
+	for _, file := range dec.fileDesc.GetFile() {
+		comments := make(map[string]string)
+		for _, loc := range file.GetSourceCodeInfo().GetLocation() {
+			if loc.LeadingComments != nil {
+				comments[fmt.Sprint(loc.GetPath())] = strings.TrimSpace(loc.GetLeadingComments())
+			}
+		}
+		for i, ext := range file.GetExtension() {
+			metas[ext] = dec.fieldMeta(ext, comments[fmt.Sprint([]int32{fileExtensionPath, int32(i)})])
+		}
+		for i, msg := range file.GetMessageType() {
+			dec.describeMessage(msg, []int32{fileMessageTypePath, int32(i)}, comments, metas)
+		}
+	}
+	describeDir(&PT.Dir, metas)
+}
+
+// Adds the metadata of the fields of msg, found at path in its file, to
+// metas.
+func (dec *Decoder) describeMessage(msg *google_protobuf.DescriptorProto, path []int32, comments map[string]string, metas map[*google_protobuf.FieldDescriptorProto]*pfuse.FieldMeta) {
+	// the path of each child is path followed by two numbers
+	child := func(kind int32, i int) string {
+		return fmt.Sprint(append(append([]int32{}, path...), kind, int32(i)))
+	}
+	for i, field := range msg.GetField() {
+		meta := dec.fieldMeta(field, comments[child(messageFieldPath, i)])
+		if field.OneofIndex != nil && int(field.GetOneofIndex()) < len(msg.GetOneofDecl()) {
+			meta.Oneof = msg.GetOneofDecl()[field.GetOneofIndex()].GetName()
+		}
+		metas[field] = meta
+	}
+	for i, ext := range msg.GetExtension() {
+		metas[ext] = dec.fieldMeta(ext, comments[child(messageExtensionPath, i)])
+	}
+	for i, nested := range msg.GetNestedType() {
+		dec.describeMessage(nested, append(append([]int32{}, path...), messageNestedPath, int32(i)), comments, metas)
+	}
+}
+
+func (dec *Decoder) fieldMeta(field *google_protobuf.FieldDescriptorProto, comments string) *pfuse.FieldMeta {
+	return &pfuse.FieldMeta{Descriptor: field, FullName: dec.fieldNames[field], Comments: comments}
+}
+
+// Sets the Meta of the nodes below dir.
+func describeDir(dir *pfuse.Dir, metas map[*google_protobuf.FieldDescriptorProto]*pfuse.FieldMeta) {
+	for _, tn := range dir.Nodes {
+		var meta *pfuse.FieldMeta
+		if tn.Field != nil {
+			meta = metas[tn.Field]
+		}
+		switch node := tn.Node.(type) {
+		case *pfuse.Dir:
+			if meta != nil {
+				node.Meta = meta
+			}
+			describeDir(node, metas)
+		case *pfuse.File:
+			if meta != nil {
+				node.Meta = meta
+			}
+		}
+	}
+}
@@ -0,0 +1,40 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package unmarshal
+
+import "fmt"
+
+// Entry is one marshaled message of the input, shown at the root of the
+// tree as a directory called Name.
+type Entry struct {
+	Name string
+	Data []byte
+	// Err is a problem found while reading the entry, such as a checksum
+	// failure, and is shown in a file called Name.error. Data is still shown
+	// if it is not nil and can be decoded.
+	Err error
+	// Message is the fully qualified name of the type of the entry, without
+	// a leading dot, if it differs from the type of the other entries.
+	Message string
+}
+
+// MessageEntries names the messages in buf Message_1, Message_2 and so on.
+func MessageEntries(buf [][]byte) []Entry {
+	entries := make([]Entry, len(buf))
+	for i, p := range buf {
+		entries[i] = Entry{Name: fmt.Sprintf("Message_%d", i+1), Data: p}
+	}
+	return entries
+}
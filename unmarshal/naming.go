@@ -0,0 +1,316 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package unmarshal
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/elrichgro/protofuse/fuse"
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+)
+
+// Naming chooses how the elements of repeated fields, which are named
+// field_1, field_2 and so on by default, and the messages at the root are
+// named.
+type Naming struct {
+	// Pad zero-pads indices to the width of the largest index in their
+	// list, so that they sort in order.
+	Pad bool
+	// Subdirs shows each repeated field as a directory named after the
+	// field, holding its elements named by their 0-based index.
+	Subdirs bool
+	// Keys names the elements of repeated message fields after the value
+	// of one of their fields, mapping the fully qualified name of the
+	// repeated field to the name of the key field, e.g. "test.foo.f12":
+	// "name". Keyed fields are shown as directories as with Subdirs.
+	// Elements without a usable key are named by their index.
+	Keys map[string]string
+	// Extensions appends an extension given by its type to the name of each
+	// field file: .json for Struct, Value and ListValue, .bin for bytes that
+	// are not text and .txt for the rest, so that file managers and editors
+	// open them with the right program.
+	Extensions bool
+}
+
+// The extensions appended by Naming.Extensions.
+var TypeExtensions = []string{".txt", ".json", ".bin"}
+
+// TrimTypeExtension splits an extension appended by Naming.Extensions off
+// name, returning name unchanged and "" if it has none.
+func TrimTypeExtension(name string) (string, string) {
+	for _, ext := range TypeExtensions {
+		if strings.HasSuffix(name, ext) && len(name) > len(ext) {
+			return strings.TrimSuffix(name, ext), ext
+		}
+	}
+	return name, ""
+}
+
+// Renames the elements of the repeated fields below dir according to
+// dec.options.Naming, and renames the nodes that would share a name with
+// another. path names dir in the warnings logged for them.
+func (dec *Decoder) applyNaming(dir *pfuse.Dir, path string) {
+	naming := dec.options.Naming
+	counts := make(map[*google_protobuf.FieldDescriptorProto]int)
+	for _, tn := range dir.Nodes {
+		if isElement(tn) {
+			counts[tn.Field]++
+		}
+	}
+
+	var nodes []pfuse.TreeNode
+	seen := make(map[*google_protobuf.FieldDescriptorProto]int)
+	lists := make(map[*google_protobuf.FieldDescriptorProto]*pfuse.Dir)
+	keys := make(map[*google_protobuf.FieldDescriptorProto]map[string]bool)
+	for i := 0; i < len(dir.Nodes); i++ {
+		tn := dir.Nodes[i]
+		// views follow the node they show
+		j := i + 1
+		for j < len(dir.Nodes) && dir.Nodes[j].View {
+			j++
+		}
+		views := dir.Nodes[i+1 : j]
+		i = j - 1
+
+		if child, ok := tn.Node.(*pfuse.Dir); ok {
+			dec.applyNaming(child, path+"/"+tn.Name)
+		}
+		if !isElement(tn) {
+			nodes = append(nodes, tn)
+			nodes = append(nodes, views...)
+			continue
+		}
+
+		field := tn.Field
+		index := seen[field]
+		seen[field]++
+		keyField, keyed := naming.Keys[dec.fieldNames[field]]
+		if !naming.Subdirs && !keyed {
+			if naming.Pad {
+				name := field.GetName() + "_" + pad(index+1, counts[field])
+				nodes = append(nodes, rename(tn, views, name)...)
+			} else {
+				nodes = append(nodes, tn)
+				nodes = append(nodes, views...)
+			}
+			continue
+		}
+
+		list, ok := lists[field]
+		if !ok {
+			list = &pfuse.Dir{List: true}
+			lists[field] = list
+			keys[field] = make(map[string]bool)
+			nodes = append(nodes, pfuse.TreeNode{Name: field.GetName(), FieldNumber: tn.FieldNumber, Type: tn.Type, Label: tn.Label, Field: field, Node: list})
+		}
+		name := ""
+		if keyed {
+			name = key(tn, keyField)
+			if name != "" && keys[field][name] {
+				log.Printf("%s/%s: more than one element has the key %s, naming element %d by its index", path, field.GetName(), name, index)
+				name = ""
+			}
+			keys[field][name] = true
+		}
+		if name == "" {
+			name = strconv.Itoa(index)
+			if naming.Pad {
+				name = pad(index, counts[field]-1)
+			}
+		}
+		list.Nodes = append(list.Nodes, rename(tn, views, name)...)
+	}
+
+	if naming.Extensions {
+		addExtensions(nodes)
+		for _, list := range lists {
+			addExtensions(list.Nodes)
+		}
+	}
+
+	dir.Nodes = nodes
+	disambiguate(dir, path)
+	for _, tn := range nodes {
+		if list, ok := tn.Node.(*pfuse.Dir); ok && list.List {
+			disambiguate(list, path+"/"+tn.Name)
+		}
+	}
+}
+
+// Appends the extension given by its type to the name of each field file
+// of nodes.
+func addExtensions(nodes []pfuse.TreeNode) {
+	for i, tn := range nodes {
+		file, ok := tn.Node.(*pfuse.File)
+		if !ok || tn.View || tn.Field == nil {
+			continue
+		}
+		switch {
+		case tn.Type == google_protobuf.FieldDescriptorProto_TYPE_BYTES && !utf8.ValidString(file.Contents):
+			nodes[i].Name += ".bin"
+		case jsonTypes[tn.Field.GetTypeName()]:
+			nodes[i].Name += ".json"
+		default:
+			nodes[i].Name += ".txt"
+		}
+	}
+}
+
+// Well-known types shown as JSON documents.
+var jsonTypes = map[string]bool{
+	".google.protobuf.Struct":    true,
+	".google.protobuf.Value":     true,
+	".google.protobuf.ListValue": true,
+}
+
+// Reports whether tn is an element of a repeated field.
+func isElement(tn pfuse.TreeNode) bool {
+	return !tn.View && tn.Field != nil && tn.Label == google_protobuf.FieldDescriptorProto_LABEL_REPEATED
+}
+
+// Renames tn to name, along with its views, which keep their extensions.
+func rename(tn pfuse.TreeNode, views []pfuse.TreeNode, name string) []pfuse.TreeNode {
+	nodes := []pfuse.TreeNode{tn}
+	nodes[0].Name = name
+	for _, view := range views {
+		view.Name = name + strings.TrimPrefix(view.Name, tn.Name)
+		nodes = append(nodes, view)
+	}
+	return nodes
+}
+
+// Zero-pads i to the width of max.
+func pad(i int, max int) string {
+	return fmt.Sprintf("%0*d", len(strconv.Itoa(max)), i)
+}
+
+// Gets the value of the field keyField of the message element tn for use
+// as its name, or "" if it has none that can be used.
+func key(tn pfuse.TreeNode, keyField string) string {
+	dir, ok := tn.Node.(*pfuse.Dir)
+	if !ok {
+		return ""
+	}
+	for _, child := range dir.Nodes {
+		// the key field may already carry a type extension
+		if name, _ := TrimTypeExtension(child.Name); name != keyField || child.View {
+			continue
+		}
+		file, ok := child.Node.(*pfuse.File)
+		if !ok || file.Contents == pfuse.Redacted {
+			return ""
+		}
+		name := strings.Replace(strings.TrimSpace(file.Contents), "/", "%2F", -1)
+		if name == "" || name == "." || name == ".." || strings.HasPrefix(name, ".") {
+			return ""
+		}
+		return name
+	}
+	return ""
+}
+
+// Renames the nodes of dir that share a name with another, so that each can
+// be looked up, logging a warning for each. Nodes other than elements of
+// repeated fields keep their names. Names ending in a number, such as the
+// index of an element, are renamed by padding the number with another zero,
+// which pack reads as the same index, and others by a numbered suffix.
+// path names dir in the warnings.
+func disambiguate(dir *pfuse.Dir, path string) {
+	// each node is renamed along with the views that follow it
+	var starts []int
+	for i, tn := range dir.Nodes {
+		if !tn.View {
+			starts = append(starts, i)
+		}
+	}
+	taken := make(map[string]bool)
+	for _, elements := range []bool{false, true} {
+		for k, i := range starts {
+			end := len(dir.Nodes)
+			if k+1 < len(starts) {
+				end = starts[k+1]
+			}
+			group := dir.Nodes[i:end]
+			if isElement(group[0]) != elements {
+				continue
+			}
+			if name := group[0].Name; taken[name] {
+				renameGroup(group, unusedName(name, taken))
+				log.Printf("%s/%s names more than one node, showing one as %s", path, name, group[0].Name)
+			}
+			for _, tn := range group {
+				taken[tn.Name] = true
+			}
+		}
+	}
+}
+
+// Names that end in a number, e.g. f2_1 and 12.
+var endsInNumber = regexp.MustCompile(`^(.*?)([0-9]+)$`)
+
+// Gets a name like name that is not taken.
+func unusedName(name string, taken map[string]bool) string {
+	base, ext := TrimTypeExtension(name)
+	if m := endsInNumber.FindStringSubmatch(base); m != nil {
+		for n := "0" + m[2]; ; n = "0" + n {
+			if !taken[m[1]+n+ext] {
+				return m[1] + n + ext
+			}
+		}
+	}
+	for i := 2; ; i++ {
+		if s := fmt.Sprintf("%s~%d%s", base, i, ext); !taken[s] {
+			return s
+		}
+	}
+}
+
+// Renames the first node of group to name, along with the views that
+// follow it, which keep their extensions.
+func renameGroup(group []pfuse.TreeNode, name string) {
+	oldBase, _ := TrimTypeExtension(group[0].Name)
+	base, _ := TrimTypeExtension(name)
+	group[0].Name = name
+	for i := 1; i < len(group); i++ {
+		group[i].Name = base + strings.TrimPrefix(group[i].Name, oldBase)
+	}
+}
+
+// Names of the entries at the root that are numbered, e.g. Message_1 and
+// Record_12.error.
+var numbered = regexp.MustCompile(`^(.*_)([0-9]+)(\.error)?$`)
+
+// Zero-pads the numbers in the names of the entries at the root of PT.
+func padEntries(PT *pfuse.ProtoTree) {
+	max := make(map[string]int)
+	for _, tn := range PT.Dir.Nodes {
+		if m := numbered.FindStringSubmatch(tn.Name); m != nil {
+			if i, _ := strconv.Atoi(m[2]); i > max[m[1]] {
+				max[m[1]] = i
+			}
+		}
+	}
+	for i, tn := range PT.Dir.Nodes {
+		if m := numbered.FindStringSubmatch(tn.Name); m != nil {
+			n, _ := strconv.Atoi(m[2])
+			PT.Dir.Nodes[i].Name = m[1] + pad(n, max[m[1]]) + m[3]
+		}
+	}
+}
@@ -0,0 +1,105 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package unmarshal
+
+import (
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+)
+
+// Options control how decoded values are presented in the tree.
+// The zero value gives the default presentation.
+type Options struct {
+	// Rendering used for bytes fields.
+	Bytes BytesFormat
+	// Per-field overrides of Bytes, keyed by fully qualified field
+	// name, e.g. "test.foo.f11".
+	FieldBytes map[string]BytesFormat
+	// Alternate renderings of bytes fields, added next to the field as
+	// e.g. f11.b64 and f11.raw.
+	BytesViews []BytesFormat
+	// Bytes fields that carry serialized messages, mapping the fully
+	// qualified field name to the fully qualified message type, e.g.
+	// "test.foo.f11": "test.bar". Such fields are decoded and shown as
+	// directories, falling back to the bytes rendering if decoding fails.
+	Embedded map[string]string
+	// Show google.protobuf.Any values as their type_url and value fields
+	// instead of expanding the packed message.
+	KeepAny bool
+	// Show well-known types such as google.protobuf.Timestamp as
+	// directories of their fields, instead of as a single file holding
+	// their canonical JSON form.
+	StructuralWellKnownTypes bool
+	// Custom field options that drive presentation: redaction, units and
+	// formatting are read from the descriptors of the decoded fields.
+	Annotations Annotations
+	// Show the values of fields marked sensitive instead of redacting them.
+	ShowSensitive bool
+	// Naming of the elements of repeated fields and of the messages at
+	// the root.
+	Naming Naming
+}
+
+// Decoder decodes messages described by a set of descriptors, presenting
+// them according to a set of options. It holds all the state of a decode
+// and does not change once made, so that sources with different schemas
+// can be decoded at the same time.
+type Decoder struct {
+	fileDesc *google_protobuf.FileDescriptorSet
+	options  Options
+	// Fully qualified names of all fields in fileDesc, without a leading dot.
+	fieldNames map[*google_protobuf.FieldDescriptorProto]string
+	// Custom options set on the fields of fileDesc.
+	annotations map[*google_protobuf.FieldDescriptorProto]*annotation
+	// Field numbers of the options named in options.Annotations.
+	sensitiveOption, unitOption, formatOption int32
+}
+
+// NewDecoder makes a Decoder for the messages described by fDesc, presented
+// according to opts.
+func NewDecoder(fDesc *google_protobuf.FileDescriptorSet, opts Options) *Decoder {
+	dec := &Decoder{fileDesc: fDesc, options: opts, fieldNames: indexFieldNames(fDesc)}
+	dec.resolveAnnotations(opts.Annotations)
+	return dec
+}
+
+func indexFieldNames(fDesc *google_protobuf.FileDescriptorSet) map[*google_protobuf.FieldDescriptorProto]string {
+	names := make(map[*google_protobuf.FieldDescriptorProto]string)
+	for _, file := range fDesc.GetFile() {
+		prefix := file.GetPackage()
+		if prefix != "" {
+			prefix += "."
+		}
+		for _, ext := range file.GetExtension() {
+			names[ext] = prefix + ext.GetName()
+		}
+		for _, msg := range file.GetMessageType() {
+			indexMessageFields(msg, prefix, names)
+		}
+	}
+	return names
+}
+
+func indexMessageFields(msg *google_protobuf.DescriptorProto, prefix string, names map[*google_protobuf.FieldDescriptorProto]string) {
+	prefix += msg.GetName() + "."
+	for _, field := range msg.GetField() {
+		names[field] = prefix + field.GetName()
+	}
+	for _, ext := range msg.GetExtension() {
+		names[ext] = prefix + ext.GetName()
+	}
+	for _, nested := range msg.GetNestedType() {
+		indexMessageFields(nested, prefix, names)
+	}
+}
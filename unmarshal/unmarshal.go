@@ -19,41 +19,83 @@ package unmarshal
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/hex"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"unsafe"
 
 	"github.com/elrichgro/protofuse/fuse"
+	"github.com/gogo/protobuf/proto"
 	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
 )
 
-var fileDesc *google_protobuf.FileDescriptorSet
-
 func Unmarshal(fDesc *google_protobuf.FileDescriptorSet, packageName string, messageName string, buf [][]byte) (*pfuse.ProtoTree, error) {
-	fileDesc = fDesc
+	return UnmarshalOptions(fDesc, packageName, messageName, buf, Options{})
+}
+
+// UnmarshalOptions is like Unmarshal, but presents the decoded values according to opts.
+func UnmarshalOptions(fDesc *google_protobuf.FileDescriptorSet, packageName string, messageName string, buf [][]byte, opts Options) (*pfuse.ProtoTree, error) {
+	return UnmarshalEntries(fDesc, packageName, messageName, MessageEntries(buf), opts)
+}
+
+// UnmarshalEntries is like UnmarshalOptions, but names the messages after
+// their entries and shows the errors of entries next to them.
+func UnmarshalEntries(fDesc *google_protobuf.FileDescriptorSet, packageName string, messageName string, entries []Entry, opts Options) (*pfuse.ProtoTree, error) {
+	return NewDecoder(fDesc, opts).Unmarshal(packageName, messageName, entries)
+}
+
+// Unmarshal decodes entries, which hold messages of type messageName in
+// package packageName unless they name their own, into a tree as
+// UnmarshalEntries does.
+func (dec *Decoder) Unmarshal(packageName string, messageName string, entries []Entry) (*pfuse.ProtoTree, error) {
 	PT := &pfuse.ProtoTree{}
-	msg := fileDesc.GetMessage(packageName, messageName)
+	msg := dec.fileDesc.GetMessage(packageName, messageName)
 	if msg == nil {
 		return nil, fmt.Errorf("Could not find message %s in package %s\n", messageName, packageName)
 	}
 
 	// unmarshal messages
-	for i, buffer := range buf {
-		PT.Dir.Nodes = append(PT.Dir.Nodes, pfuse.TreeNode{Name: fmt.Sprintf("Message_%d", i+1), FieldNumber: 0, Type: google_protobuf.FieldDescriptorProto_TYPE_MESSAGE})
-		err := unmarshalMessage(msg, bytes.NewBuffer(buffer), &PT.Dir.Nodes[i], packageName)
+	for _, entry := range entries {
+		tn := pfuse.TreeNode{Name: entry.Name, FieldNumber: 0, Type: google_protobuf.FieldDescriptorProto_TYPE_MESSAGE}
+		entryMsg, entryPackage := msg, packageName
+		var err error
+		if entry.Message != "" {
+			entryMsg, entryPackage, err = dec.getDescriptorProto("." + entry.Message)
+		}
+		if err == nil && (entry.Data != nil || entry.Err == nil) {
+			err = dec.unmarshalMessage(entryMsg, bytes.NewBuffer(entry.Data), &tn, entryPackage)
+			if err == nil {
+				dec.applyNaming(tn.Node.(*pfuse.Dir), entry.Name)
+				PT.Dir.Nodes = append(PT.Dir.Nodes, tn)
+			}
+		}
+		if entry.Err == nil {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		contents := entry.Err.Error() + "\n"
 		if err != nil {
-			return nil, err
+			contents += err.Error() + "\n"
 		}
+		PT.Dir.Nodes = append(PT.Dir.Nodes, pfuse.TreeNode{Name: entry.Name + ".error", Node: &pfuse.File{Contents: contents}})
+	}
+	if dec.options.Naming.Pad {
+		padEntries(PT)
 	}
+	dec.describe(PT)
 	return PT, nil
 }
 
-func unmarshalMessage(msg *google_protobuf.DescriptorProto, buf *bytes.Buffer, t *pfuse.TreeNode, packageName string) error {
+func (dec *Decoder) unmarshalMessage(msg *google_protobuf.DescriptorProto, buf *bytes.Buffer, t *pfuse.TreeNode, packageName string) error {
 	var repNum int32 = 0
 	var m map[int32]int32 = make(map[int32]int32)
-	dir := &pfuse.Dir{}
+	dir := &pfuse.Dir{Raw: buf.Bytes()}
+	if dir.Raw == nil {
+		dir.Raw = []byte{}
+	}
 
 	for buf.Len() != 0 {
 		tN := &pfuse.TreeNode{}
@@ -67,13 +109,13 @@ func unmarshalMessage(msg *google_protobuf.DescriptorProto, buf *bytes.Buffer, t
 
 		// check if field is an extension
 		if isExtension(msg, fieldNumber) {
-			_, field = fileDesc.FindExtensionByFieldNumber(packageName, msg.GetName(), fieldNumber)
+			_, field = dec.fileDesc.FindExtensionByFieldNumber(packageName, msg.GetName(), fieldNumber)
 			if field == nil {
 				return fmt.Errorf("Could not find extension: %d, of message %s\n", fieldNumber, msg.GetName())
 			}
 		} else {
 			field, err = getField(msg, fieldNumber)
-			if field != {
+			if err != nil {
 				return err
 			}
 		}
@@ -95,28 +137,36 @@ func unmarshalMessage(msg *google_protobuf.DescriptorProto, buf *bytes.Buffer, t
 		}
 
 		if packed {
-			len, n := binary.Uvarint(buf.Bytes())
-			if n <= 0 {
-				return fmt.Errorf("decodeVarint n = %d", n)
+			values, err := readLengthDelimited(field, buf)
+			if err != nil {
+				return err
 			}
-			buf.Next(n)
-			p := bytes.NewBuffer(buf.Next(int(len)))
+			p := bytes.NewBuffer(values)
 			for p.Len() != 0 {
 				tN = &pfuse.TreeNode{}
-				err = unmarshalPacked(field, p, tN, repNum)
+				err = dec.unmarshalPacked(field, p, tN, repNum)
 				if err != nil {
 					return err
 				}
+				if dec.annotate(field, tN) {
+					dir.Redacted = true
+				}
 				m[fieldNumber] += 1
 				repNum = m[fieldNumber]
 				dir.Nodes = append(dir.Nodes, *tN)
 			}
 		} else {
-			err = unmarshalField(wireType, field, buf, tN, repNum)
+			err = dec.unmarshalField(wireType, field, buf, tN, repNum)
 			if err != nil {
 				return err
 			}
+			if dec.annotate(field, tN) {
+				dir.Redacted = true
+			}
 			dir.Nodes = append(dir.Nodes, *tN)
+			if field.GetType() == google_protobuf.FieldDescriptorProto_TYPE_BYTES {
+				dir.Nodes = append(dir.Nodes, dec.bytesViews(tN)...)
+			}
 		}
 	}
 	t.Node = dir
@@ -124,35 +174,35 @@ func unmarshalMessage(msg *google_protobuf.DescriptorProto, buf *bytes.Buffer, t
 	return nil
 }
 
-func unmarshalField(wireType int8, field *google_protobuf.FieldDescriptorProto, buf *bytes.Buffer, tN *pfuse.TreeNode, repNum int32) error {
+func (dec *Decoder) unmarshalField(wireType int8, field *google_protobuf.FieldDescriptorProto, buf *bytes.Buffer, tN *pfuse.TreeNode, repNum int32) error {
 	switch wireType {
 	case 0:
-		err := unmarshal0(field, buf, tN, repNum)
+		err := dec.unmarshal0(field, buf, tN, repNum)
 		if err != nil {
 			return err
 		}
 	case 1:
-		err := unmarshal1(field, buf, tN, repNum)
+		err := dec.unmarshal1(field, buf, tN, repNum)
 		if err != nil {
 			return err
 		}
 	case 2:
-		err := unmarshal2(field, buf, tN, repNum)
+		err := dec.unmarshal2(field, buf, tN, repNum)
 		if err != nil {
 			return err
 		}
 	case 3:
-		err := unmarshal3(field, buf, tN, repNum)
+		err := dec.unmarshal3(field, buf, tN, repNum)
 		if err != nil {
 			return err
 		}
 	case 4:
-		err := unmarshal4(field, buf, tN, repNum)
+		err := dec.unmarshal4(field, buf, tN, repNum)
 		if err != nil {
 			return err
 		}
 	case 5:
-		err := unmarshal5(field, buf, tN, repNum)
+		err := dec.unmarshal5(field, buf, tN, repNum)
 		if err != nil {
 			return err
 		}
@@ -172,7 +222,7 @@ func decodeKey(buf *bytes.Buffer) (int8, int32, error) {
 	return int8(x & 7), int32(x >> 3), nil
 }
 
-func unmarshal0(field *google_protobuf.FieldDescriptorProto, buf *bytes.Buffer, t *pfuse.TreeNode, rN int32) error {
+func (dec *Decoder) unmarshal0(field *google_protobuf.FieldDescriptorProto, buf *bytes.Buffer, t *pfuse.TreeNode, rN int32) error {
 	var contents string
 	if rN != 0 {
 		t.Name = fmt.Sprintf(field.GetName()+"_%d", rN)
@@ -181,6 +231,7 @@ func unmarshal0(field *google_protobuf.FieldDescriptorProto, buf *bytes.Buffer,
 	}
 	t.Type = field.GetType()
 	t.Label = field.GetLabel()
+	t.Field = field
 
 	switch *field.Type {
 	case google_protobuf.FieldDescriptorProto_TYPE_INT32:
@@ -237,7 +288,7 @@ func unmarshal0(field *google_protobuf.FieldDescriptorProto, buf *bytes.Buffer,
 			contents = "False"
 		}
 	case google_protobuf.FieldDescriptorProto_TYPE_ENUM:
-		e, err := getEnumDescriptorProto(field.GetTypeName())
+		e, err := dec.getEnumDescriptorProto(field.GetTypeName())
 		if err != nil {
 			return err
 		}
@@ -259,13 +310,15 @@ func unmarshal0(field *google_protobuf.FieldDescriptorProto, buf *bytes.Buffer,
 	default:
 		return fmt.Errorf("Invalid wire type")
 	}
-	t.Node = &pfuse.File{contents}
+	t.Node = &pfuse.File{Contents: contents}
 	return nil
 }
 
-func unmarshal1(field *google_protobuf.FieldDescriptorProto, buf *bytes.Buffer, t *pfuse.TreeNode, rN int32) error {
-	p := make([]byte, 8)
-	buf.Read(p)
+func (dec *Decoder) unmarshal1(field *google_protobuf.FieldDescriptorProto, buf *bytes.Buffer, t *pfuse.TreeNode, rN int32) error {
+	if buf.Len() < 8 {
+		return fmt.Errorf("Field %s is truncated", field.GetName())
+	}
+	p := buf.Next(8)
 	// Set file name
 	if rN != 0 {
 		t.Name = fmt.Sprintf(field.GetName()+"_%d", rN)
@@ -274,6 +327,7 @@ func unmarshal1(field *google_protobuf.FieldDescriptorProto, buf *bytes.Buffer,
 	}
 	t.Type = field.GetType()
 	t.Label = field.GetLabel()
+	t.Field = field
 
 	switch *field.Type {
 	case google_protobuf.FieldDescriptorProto_TYPE_DOUBLE:
@@ -281,33 +335,46 @@ func unmarshal1(field *google_protobuf.FieldDescriptorProto, buf *bytes.Buffer,
 		if err != nil {
 			return err
 		}
-		t.Node = &pfuse.File{fmt.Sprintf("%.6f", x)}
+		t.Node = &pfuse.File{Contents: strconv.FormatFloat(x, 'g', -1, 64)}
 	case google_protobuf.FieldDescriptorProto_TYPE_FIXED64:
 		x, err := decodeFixed64(p)
 		if err != nil {
 			return err
 		}
-		t.Node = &pfuse.File{fmt.Sprintf("%d", x)}
+		t.Node = &pfuse.File{Contents: fmt.Sprintf("%d", x)}
 	case google_protobuf.FieldDescriptorProto_TYPE_SFIXED64:
 		x, err := decodeSfixed64(p)
 		if err != nil {
 			return err
 		}
-		t.Node = &pfuse.File{fmt.Sprintf("%d", x)}
+		t.Node = &pfuse.File{Contents: fmt.Sprintf("%d", x)}
 	default:
-		t.Node = &pfuse.File{fmt.Sprintf("%x", p)}
+		t.Node = &pfuse.File{Contents: fmt.Sprintf("%x", p)}
 	}
 	return nil
 }
 
-func unmarshal2(field *google_protobuf.FieldDescriptorProto, buf *bytes.Buffer, t *pfuse.TreeNode, rN int32) error {
-	len, n := binary.Uvarint(buf.Bytes())
+// Reads the length prefixed value of field from buf, failing if the length
+// runs past the end of buf.
+func readLengthDelimited(field *google_protobuf.FieldDescriptorProto, buf *bytes.Buffer) ([]byte, error) {
+	length, n := binary.Uvarint(buf.Bytes())
 	if n <= 0 {
-		return fmt.Errorf("decodeVarint n = %d", n)
+		return nil, fmt.Errorf("decodeVarint n = %d", n)
 	}
 	buf.Next(n)
-	p := make([]byte, len)
+	if length > uint64(buf.Len()) {
+		return nil, fmt.Errorf("Length %d of field %s runs past the %d bytes left", length, field.GetName(), buf.Len())
+	}
+	p := make([]byte, length)
 	buf.Read(p)
+	return p, nil
+}
+
+func (dec *Decoder) unmarshal2(field *google_protobuf.FieldDescriptorProto, buf *bytes.Buffer, t *pfuse.TreeNode, rN int32) error {
+	p, err := readLengthDelimited(field, buf)
+	if err != nil {
+		return err
+	}
 	// Set file name
 	if rN != 0 {
 		t.Name = fmt.Sprintf(field.GetName()+"_%d", rN)
@@ -316,38 +383,141 @@ func unmarshal2(field *google_protobuf.FieldDescriptorProto, buf *bytes.Buffer,
 	}
 	t.Type = field.GetType()
 	t.Label = field.GetLabel()
+	t.Field = field
 
 	switch *field.Type {
 	case google_protobuf.FieldDescriptorProto_TYPE_STRING:
-		t.Node = &pfuse.File{string(p)}
+		t.Node = &pfuse.File{Contents: string(p)}
 	case google_protobuf.FieldDescriptorProto_TYPE_BYTES:
-		t.Node = &pfuse.File{hex.EncodeToString(p)}
+		if typeName, ok := dec.options.Embedded[dec.fieldNames[field]]; ok {
+			if err := dec.unmarshalEmbedded(typeName, p, t); err == nil {
+				break
+			}
+		}
+		t.Node = &pfuse.File{Contents: formatBytes(p, dec.FieldBytesFormat(field)), Raw: p}
 	case google_protobuf.FieldDescriptorProto_TYPE_MESSAGE:
 		var messageName string = field.GetTypeName()
-		packageName := strings.Split(messageName, ".")[1]
-		messageDesc, err := getDescriptorProto(messageName)
+		if _, ok := wellKnownTypes[messageName]; ok && !dec.options.StructuralWellKnownTypes {
+			if file, err := dec.unmarshalWellKnown(messageName, p); err == nil {
+				t.Node = file
+				break
+			}
+		}
+		if messageName == ".google.protobuf.Any" && !dec.options.KeepAny {
+			if err := dec.unmarshalAny(p, t); err == nil {
+				break
+			}
+		}
+		messageDesc, packageName, err := dec.getDescriptorProto(messageName)
 		if err != nil {
 			return err
 		}
-		unmarshalMessage(messageDesc, bytes.NewBuffer(p), t, packageName)
+		if err := dec.unmarshalMessage(messageDesc, bytes.NewBuffer(p), t, packageName); err != nil {
+			return err
+		}
+		t.Node.(*pfuse.Dir).MapEntry = messageDesc.GetOptions().GetMapEntry()
 	default:
-		t.Node = &pfuse.File{string(p)}
+		t.Node = &pfuse.File{Contents: string(p)}
 	}
 
 	return nil
 }
 
-func unmarshal3(field *google_protobuf.FieldDescriptorProto, buf *bytes.Buffer, t *pfuse.TreeNode, rN int32) error {
+// Decodes a bytes field holding a serialized message of type typeName into t.
+// t is left unchanged if the bytes cannot be decoded as that message.
+func (dec *Decoder) unmarshalEmbedded(typeName string, p []byte, t *pfuse.TreeNode) error {
+	if !strings.HasPrefix(typeName, ".") {
+		typeName = "." + typeName
+	}
+	messageDesc, packageName, err := dec.getDescriptorProto(typeName)
+	if err != nil {
+		return err
+	}
+	return dec.unmarshalMessage(messageDesc, bytes.NewBuffer(p), t, packageName)
+}
+
+// Decodes a google.protobuf.Any into t as the message it packs, with the
+// type_url shown as an @type file. t is left unchanged if the type_url cannot
+// be resolved against fileDesc or the value cannot be decoded.
+func (dec *Decoder) unmarshalAny(p []byte, t *pfuse.TreeNode) error {
+	fields, err := readFields(p)
+	if err != nil {
+		return err
+	}
+	var typeURL string
+	var value []byte
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			typeURL = string(f.bytes)
+		case 2:
+			value = f.bytes
+		}
+	}
+	typeName := "." + typeURL[strings.LastIndex(typeURL, "/")+1:]
+	typeField := &google_protobuf.FieldDescriptorProto{Name: proto.String("@type"), Number: proto.Int32(1),
+		Type: google_protobuf.FieldDescriptorProto_TYPE_STRING.Enum(), Label: google_protobuf.FieldDescriptorProto_LABEL_OPTIONAL.Enum()}
+	typeNode := pfuse.TreeNode{Name: "@type", FieldNumber: pfuse.TypeURLFieldNumber, Type: typeField.GetType(), Label: typeField.GetLabel(),
+		Node: &pfuse.File{Contents: typeURL}, Field: typeField}
+
+	// well-known types are packed as a single value, as in the JSON mapping
+	if _, ok := wellKnownTypes[typeName]; ok && !dec.options.StructuralWellKnownTypes {
+		file, err := dec.unmarshalWellKnown(typeName, value)
+		if err != nil {
+			return err
+		}
+		valueField := &google_protobuf.FieldDescriptorProto{Name: proto.String("value"), Number: proto.Int32(2), TypeName: proto.String(typeName),
+			Type: google_protobuf.FieldDescriptorProto_TYPE_MESSAGE.Enum(), Label: google_protobuf.FieldDescriptorProto_LABEL_OPTIONAL.Enum()}
+		valueNode := pfuse.TreeNode{Name: "value", FieldNumber: 2, Type: valueField.GetType(), Label: valueField.GetLabel(),
+			Node: file, Field: valueField}
+		t.Node = &pfuse.Dir{Nodes: []pfuse.TreeNode{typeNode, valueNode}, Raw: p}
+		return nil
+	}
+
+	messageDesc, packageName, err := dec.getDescriptorProto(typeName)
+	if err != nil {
+		return err
+	}
+	err = dec.unmarshalMessage(messageDesc, bytes.NewBuffer(value), t, packageName)
+	if err != nil {
+		return err
+	}
+	dir := t.Node.(*pfuse.Dir)
+	dir.Nodes = append([]pfuse.TreeNode{typeNode}, dir.Nodes...)
+	dir.Raw = p
+	return nil
+}
+
+// Decodes a well-known type into a file holding its JSON form. The fields
+// of the message are kept alongside for exporting it in the text format.
+func (dec *Decoder) unmarshalWellKnown(typeName string, p []byte) (*pfuse.File, error) {
+	contents, err := wellKnownTypes[typeName](p)
+	if err != nil {
+		return nil, err
+	}
+	file := &pfuse.File{Contents: contents}
+	if messageDesc, packageName, err := dec.getDescriptorProto(typeName); err == nil {
+		t := &pfuse.TreeNode{}
+		if dec.unmarshalMessage(messageDesc, bytes.NewBuffer(p), t, packageName) == nil {
+			file.Message = t.Node.(*pfuse.Dir)
+		}
+	}
+	return file, nil
+}
+
+func (dec *Decoder) unmarshal3(field *google_protobuf.FieldDescriptorProto, buf *bytes.Buffer, t *pfuse.TreeNode, rN int32) error {
 	return errors.New("Groups are not supported")
 }
 
-func unmarshal4(field *google_protobuf.FieldDescriptorProto, buf *bytes.Buffer, t *pfuse.TreeNode, rN int32) error {
+func (dec *Decoder) unmarshal4(field *google_protobuf.FieldDescriptorProto, buf *bytes.Buffer, t *pfuse.TreeNode, rN int32) error {
 	return errors.New("Groups are not supported")
 }
 
-func unmarshal5(field *google_protobuf.FieldDescriptorProto, buf *bytes.Buffer, t *pfuse.TreeNode, rN int32) error {
-	p := make([]byte, 4)
-	buf.Read(p)
+func (dec *Decoder) unmarshal5(field *google_protobuf.FieldDescriptorProto, buf *bytes.Buffer, t *pfuse.TreeNode, rN int32) error {
+	if buf.Len() < 4 {
+		return fmt.Errorf("Field %s is truncated", field.GetName())
+	}
+	p := buf.Next(4)
 	// Set file name
 	if rN != 0 {
 		t.Name = fmt.Sprintf(field.GetName()+"_%d", rN)
@@ -356,6 +526,7 @@ func unmarshal5(field *google_protobuf.FieldDescriptorProto, buf *bytes.Buffer,
 	}
 	t.Type = field.GetType()
 	t.Label = field.GetLabel()
+	t.Field = field
 
 	switch *field.Type {
 	case google_protobuf.FieldDescriptorProto_TYPE_FLOAT:
@@ -363,46 +534,45 @@ func unmarshal5(field *google_protobuf.FieldDescriptorProto, buf *bytes.Buffer,
 		if err != nil {
 			return err
 		}
-		t.Node = &pfuse.File{fmt.Sprintf("%.6f", x)}
+		t.Node = &pfuse.File{Contents: strconv.FormatFloat(float64(x), 'g', -1, 32)}
 	case google_protobuf.FieldDescriptorProto_TYPE_FIXED32:
 		x, err := decodeFixed32(p)
 		if err != nil {
 			return err
 		}
-		t.Node = &pfuse.File{fmt.Sprintf("%d", x)}
+		t.Node = &pfuse.File{Contents: fmt.Sprintf("%d", x)}
 	case google_protobuf.FieldDescriptorProto_TYPE_SFIXED32:
 		x, err := decodeSfixed32(p)
 		if err != nil {
 			return err
 		}
-		t.Node = &pfuse.File{fmt.Sprintf("%d", x)}
+		t.Node = &pfuse.File{Contents: fmt.Sprintf("%d", x)}
 	default:
-		t.Node = &pfuse.File{fmt.Sprintf("%x", p)}
+		t.Node = &pfuse.File{Contents: fmt.Sprintf("%x", p)}
 	}
 
 	return nil
 }
 
-func unmarshalPacked(field *google_protobuf.FieldDescriptorProto, buf *bytes.Buffer, t *pfuse.TreeNode, rN int32) error {
+func (dec *Decoder) unmarshalPacked(field *google_protobuf.FieldDescriptorProto, buf *bytes.Buffer, t *pfuse.TreeNode, rN int32) error {
 	ft := field.GetType()
 	if ft == google_protobuf.FieldDescriptorProto_TYPE_INT32 || ft == google_protobuf.FieldDescriptorProto_TYPE_INT64 ||
 		ft == google_protobuf.FieldDescriptorProto_TYPE_UINT32 || ft == google_protobuf.FieldDescriptorProto_TYPE_UINT64 ||
 		ft == google_protobuf.FieldDescriptorProto_TYPE_SINT32 || ft == google_protobuf.FieldDescriptorProto_TYPE_SINT64 ||
 		ft == google_protobuf.FieldDescriptorProto_TYPE_BOOL || ft == google_protobuf.FieldDescriptorProto_TYPE_ENUM {
 			t.FieldNumber = field.GetNumber()
-			unmarshal0(field, buf, t, rN)
+			return dec.unmarshal0(field, buf, t, rN)
 	} else if ft == google_protobuf.FieldDescriptorProto_TYPE_FIXED64 || ft == google_protobuf.FieldDescriptorProto_TYPE_SFIXED64 ||
 		ft == google_protobuf.FieldDescriptorProto_TYPE_DOUBLE {
 			t.FieldNumber = field.GetNumber()
-			unmarshal1(field, buf, t, rN)
+			return dec.unmarshal1(field, buf, t, rN)
 	} else if ft == google_protobuf.FieldDescriptorProto_TYPE_FIXED32 || ft == google_protobuf.FieldDescriptorProto_TYPE_SFIXED32 ||
 		ft == google_protobuf.FieldDescriptorProto_TYPE_FLOAT {
 			t.FieldNumber = field.GetNumber()
-			unmarshal5(field, buf, t, rN)
+			return dec.unmarshal5(field, buf, t, rN)
 	} else {
 		return fmt.Errorf("Invalid packed type\n")
 	}
-	return nil
 }
 
 func decodeBool(buf []byte) (bool, int, error) {
@@ -503,46 +673,54 @@ func decodeSint64(buf []byte) (int64, int, error) {
 	return int64((v >> 1) ^ uint64((int64(v&1)<<63)>>63)), n, nil
 }
 
-// Finds the google_protobuf.DescriptorProto for the message name.
-func getDescriptorProto(name string) (*google_protobuf.DescriptorProto, error) {
-	if string(name[0]) == "." {
-		s := strings.Split(name, ".")
-		slen := len(s)
-		for _, file := range fileDesc.File {
-			if file.GetPackage() == s[1] {
-				for _, message := range file.MessageType {
-					if message.GetName() == s[2] {
-						if slen <= 3 {
-							return message, nil
-						}
-						var m *google_protobuf.DescriptorProto = message
+// Finds the google_protobuf.DescriptorProto for the fully qualified message name,
+// along with the name of the package it is declared in.
+func (dec *Decoder) getDescriptorProto(name string) (*google_protobuf.DescriptorProto, string, error) {
+	return findDescriptorProto(dec.fileDesc, name)
+}
 
-						for i := 3; i < slen; i++ {
-							for _, d := range m.GetNestedType() {
-								if d.GetName() == s[i] {
-									if i >= slen-1 {
-										return d, nil
-									}
-									m = d
-								}
-							}
-						}
-						return nil, fmt.Errorf("Cannot find message: %s", name)
-					}
+// Finds the message called name among the descriptors of fDesc, like
+// getDescriptorProto.
+func findDescriptorProto(fDesc *google_protobuf.FileDescriptorSet, name string) (*google_protobuf.DescriptorProto, string, error) {
+	if !strings.HasPrefix(name, ".") {
+		return nil, "", fmt.Errorf("Message name not fully qualified: %s", name)
+	}
+	for _, file := range fDesc.GetFile() {
+		prefix := "."
+		if file.GetPackage() != "" {
+			prefix += file.GetPackage() + "."
+		}
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		messages := file.GetMessageType()
+		var m *google_protobuf.DescriptorProto
+		for _, n := range strings.Split(name[len(prefix):], ".") {
+			m = nil
+			for _, d := range messages {
+				if d.GetName() == n {
+					m = d
+					break
 				}
 			}
+			if m == nil {
+				break
+			}
+			messages = m.GetNestedType()
+		}
+		if m != nil {
+			return m, file.GetPackage(), nil
 		}
-		return nil, fmt.Errorf("Cannot find message: %s", name)
 	}
-	return nil, fmt.Errorf("Message name not fully qualified: %s", name)
+	return nil, "", fmt.Errorf("Cannot find message: %s", name)
 }
 
 // Gets the google_protobuf.EnumDescriptorProto for name
-func getEnumDescriptorProto(name string) (*google_protobuf.EnumDescriptorProto, error) {
+func (dec *Decoder) getEnumDescriptorProto(name string) (*google_protobuf.EnumDescriptorProto, error) {
 	if string(name[0]) == "." {
 		s := strings.Split(name, ".")
 		slen := len(s)
-		for _, file := range fileDesc.File {
+		for _, file := range dec.fileDesc.File {
 			if file.GetPackage() == s[1] {
 				if slen <= 3 {
 					return getEnum(s[2], file.GetEnumType())
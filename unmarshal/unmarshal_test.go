@@ -15,12 +15,19 @@
 package unmarshal
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"testing"
 	"reflect"
 	"fmt"
+	"math"
+	"strings"
+	"sync"
 
 	"github.com/elrichgro/protofuse/fuse"
 	"github.com/elrichgro/protofuse/test"
+	"github.com/gogo/protobuf/proto"
 	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
 )
 
@@ -36,8 +43,8 @@ func TestUnmarshal(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	PT2 := &pfuse.ProtoTree{pfuse.Dir{[]pfuse.TreeNode{pfuse.TreeNode{Name:"Message_1", FieldNumber:0, Type: google_protobuf.FieldDescriptorProto_TYPE_MESSAGE, 
-	Node: &pfuse.Dir{[]pfuse.TreeNode{pfuse.TreeNode{Name:"f121", FieldNumber:121, Type: google_protobuf.FieldDescriptorProto_TYPE_INT32, 
+	PT2 := &pfuse.ProtoTree{Dir: pfuse.Dir{Nodes: []pfuse.TreeNode{pfuse.TreeNode{Name:"Message_1", FieldNumber:0, Type: google_protobuf.FieldDescriptorProto_TYPE_MESSAGE, 
+	Node: &pfuse.Dir{Nodes: []pfuse.TreeNode{pfuse.TreeNode{Name:"f121", FieldNumber:121, Type: google_protobuf.FieldDescriptorProto_TYPE_INT32, 
 	Label: google_protobuf.FieldDescriptorProto_LABEL_OPTIONAL, Node:&pfuse.File{Contents:"123"}}, pfuse.TreeNode{Name:"f1", FieldNumber:1, Type: google_protobuf.FieldDescriptorProto_TYPE_STRING, 
 	Label: google_protobuf.FieldDescriptorProto_LABEL_REQUIRED, Node:&pfuse.File{Contents:"one"}}, pfuse.TreeNode{Name:"f2_1", FieldNumber:2, Type: google_protobuf.FieldDescriptorProto_TYPE_INT32, 
 	Label: google_protobuf.FieldDescriptorProto_LABEL_OPTIONAL, Node:&pfuse.File{Contents:"1"}}, pfuse.TreeNode{Name:"f2_2", FieldNumber:2, Type: google_protobuf.FieldDescriptorProto_TYPE_INT32, 
@@ -51,23 +58,23 @@ func TestUnmarshal(t *testing.T) {
 	Label: google_protobuf.FieldDescriptorProto_LABEL_OPTIONAL, Node:&pfuse.File{Contents:"True"}}, pfuse.TreeNode{Name:"f8", FieldNumber:8, Type: google_protobuf.FieldDescriptorProto_TYPE_FIXED64, 
 	Label: google_protobuf.FieldDescriptorProto_LABEL_OPTIONAL, Node:&pfuse.File{Contents:"8"}}, pfuse.TreeNode{Name:"f9", FieldNumber:9, Type: google_protobuf.FieldDescriptorProto_TYPE_SFIXED64, 
 	Label: google_protobuf.FieldDescriptorProto_LABEL_OPTIONAL, Node:&pfuse.File{Contents:"9"}}, pfuse.TreeNode{Name:"f10", FieldNumber:10, Type: google_protobuf.FieldDescriptorProto_TYPE_DOUBLE, 
-	Label: google_protobuf.FieldDescriptorProto_LABEL_OPTIONAL, Node:&pfuse.File{Contents:"10.000000"}}, pfuse.TreeNode{Name:"f11", FieldNumber:11, Type: google_protobuf.FieldDescriptorProto_TYPE_BYTES, 
+	Label: google_protobuf.FieldDescriptorProto_LABEL_OPTIONAL, Node:&pfuse.File{Contents:"10"}}, pfuse.TreeNode{Name:"f11", FieldNumber:11, Type: google_protobuf.FieldDescriptorProto_TYPE_BYTES, 
 	Label: google_protobuf.FieldDescriptorProto_LABEL_OPTIONAL, Node:&pfuse.File{Contents:"0b0b"}}, pfuse.TreeNode{Name:"f12", FieldNumber:12, Type: google_protobuf.FieldDescriptorProto_TYPE_MESSAGE, 
-	Label: google_protobuf.FieldDescriptorProto_LABEL_OPTIONAL, Node:&pfuse.Dir{[]pfuse.TreeNode{pfuse.TreeNode{Name:"name", FieldNumber:100, Type:google_protobuf.FieldDescriptorProto_TYPE_STRING, 
+	Label: google_protobuf.FieldDescriptorProto_LABEL_OPTIONAL, Node:&pfuse.Dir{Nodes: []pfuse.TreeNode{pfuse.TreeNode{Name:"name", FieldNumber:100, Type:google_protobuf.FieldDescriptorProto_TYPE_STRING, 
 	Label: google_protobuf.FieldDescriptorProto_LABEL_REQUIRED, Node:&pfuse.File{Contents:"BAR"}}, pfuse.TreeNode{Name:"id", FieldNumber:1, Type:google_protobuf.FieldDescriptorProto_TYPE_INT32, 
 	Label: google_protobuf.FieldDescriptorProto_LABEL_REQUIRED, Node:&pfuse.File{Contents:"123"}}}}}, pfuse.TreeNode{Name:"f13", FieldNumber:13, Type: google_protobuf.FieldDescriptorProto_TYPE_FIXED32, 
 	Label: google_protobuf.FieldDescriptorProto_LABEL_OPTIONAL, Node:&pfuse.File{Contents:"13"}}, pfuse.TreeNode{Name:"f14", FieldNumber:14, Type: google_protobuf.FieldDescriptorProto_TYPE_SFIXED32, 
 	Label: google_protobuf.FieldDescriptorProto_LABEL_OPTIONAL, Node:&pfuse.File{Contents:"14"}}, pfuse.TreeNode{Name:"f15", FieldNumber:15, Type: google_protobuf.FieldDescriptorProto_TYPE_FLOAT, 
-	Label: google_protobuf.FieldDescriptorProto_LABEL_OPTIONAL, Node:&pfuse.File{Contents:"15.000000"}}, pfuse.TreeNode{Name:"f16_1", FieldNumber:16, Type: google_protobuf.FieldDescriptorProto_TYPE_MESSAGE, 
-	Label: google_protobuf.FieldDescriptorProto_LABEL_REPEATED, Node:&pfuse.Dir{[]pfuse.TreeNode{pfuse.TreeNode{Name:"f1", FieldNumber:1, Type: google_protobuf.FieldDescriptorProto_TYPE_STRING, 
+	Label: google_protobuf.FieldDescriptorProto_LABEL_OPTIONAL, Node:&pfuse.File{Contents:"15"}}, pfuse.TreeNode{Name:"f16_1", FieldNumber:16, Type: google_protobuf.FieldDescriptorProto_TYPE_MESSAGE, 
+	Label: google_protobuf.FieldDescriptorProto_LABEL_REPEATED, Node:&pfuse.Dir{Nodes: []pfuse.TreeNode{pfuse.TreeNode{Name:"f1", FieldNumber:1, Type: google_protobuf.FieldDescriptorProto_TYPE_STRING, 
 	Label: google_protobuf.FieldDescriptorProto_LABEL_REQUIRED, Node:&pfuse.File{Contents:"name"}}, pfuse.TreeNode{Name:"f2", FieldNumber:2, Type: google_protobuf.FieldDescriptorProto_TYPE_ENUM, 
 	Label: google_protobuf.FieldDescriptorProto_LABEL_OPTIONAL, Node:&pfuse.File{Contents:"e1"}}, pfuse.TreeNode{Name:"f3", FieldNumber:3, Type: google_protobuf.FieldDescriptorProto_TYPE_MESSAGE, 
-	Label: google_protobuf.FieldDescriptorProto_LABEL_OPTIONAL, Node:&pfuse.Dir{[]pfuse.TreeNode{pfuse.TreeNode{Name:"name", FieldNumber:1, Type: google_protobuf.FieldDescriptorProto_TYPE_STRING, 
+	Label: google_protobuf.FieldDescriptorProto_LABEL_OPTIONAL, Node:&pfuse.Dir{Nodes: []pfuse.TreeNode{pfuse.TreeNode{Name:"name", FieldNumber:1, Type: google_protobuf.FieldDescriptorProto_TYPE_STRING, 
 	Label: google_protobuf.FieldDescriptorProto_LABEL_REQUIRED, Node:&pfuse.File{Contents:"name"}}}}}}}}, pfuse.TreeNode{Name:"f16_2", FieldNumber:16, Type: google_protobuf.FieldDescriptorProto_TYPE_MESSAGE, 
-	Label: google_protobuf.FieldDescriptorProto_LABEL_REPEATED, Node:&pfuse.Dir{[]pfuse.TreeNode{pfuse.TreeNode{Name:"f1", FieldNumber:1, Type: google_protobuf.FieldDescriptorProto_TYPE_STRING, 
+	Label: google_protobuf.FieldDescriptorProto_LABEL_REPEATED, Node:&pfuse.Dir{Nodes: []pfuse.TreeNode{pfuse.TreeNode{Name:"f1", FieldNumber:1, Type: google_protobuf.FieldDescriptorProto_TYPE_STRING, 
 	Label: google_protobuf.FieldDescriptorProto_LABEL_REQUIRED, Node:&pfuse.File{Contents:"name2"}}, pfuse.TreeNode{Name:"f2", FieldNumber:2, Type: google_protobuf.FieldDescriptorProto_TYPE_ENUM, 
 	Label: google_protobuf.FieldDescriptorProto_LABEL_OPTIONAL, Node:&pfuse.File{Contents:"e2"}}, pfuse.TreeNode{Name:"f3", FieldNumber:3, Type: google_protobuf.FieldDescriptorProto_TYPE_MESSAGE, 
-	Label: google_protobuf.FieldDescriptorProto_LABEL_OPTIONAL, Node:&pfuse.Dir{[]pfuse.TreeNode{pfuse.TreeNode{Name:"name", FieldNumber:1, Type: google_protobuf.FieldDescriptorProto_TYPE_STRING, 
+	Label: google_protobuf.FieldDescriptorProto_LABEL_OPTIONAL, Node:&pfuse.Dir{Nodes: []pfuse.TreeNode{pfuse.TreeNode{Name:"name", FieldNumber:1, Type: google_protobuf.FieldDescriptorProto_TYPE_STRING, 
 	Label: google_protobuf.FieldDescriptorProto_LABEL_REQUIRED, Node:&pfuse.File{Contents:"name2"}}}}}}}}}}}}}}
 
 	compareProtoTree(PT1, PT2, t)
@@ -121,3 +128,675 @@ func compareFile(f1 *pfuse.File, f2 *pfuse.File, t *testing.T) {
 		t.Error(fmt.Sprintf("File contents don't match: %s != %s", f1.Contents, f2.Contents))
 	}
 }
+
+func TestFormatBytes(t *testing.T) {
+	p := []byte("Hello world.\n\x00\x01")
+	tests := []struct {
+		format   BytesFormat
+		expected string
+	}{
+		{BytesHex, "48656c6c6f20776f726c642e0a0001"},
+		{BytesBase64, "SGVsbG8gd29ybGQuCgAB"},
+		{BytesRaw, "Hello world.\n\x00\x01"},
+		{BytesAuto, "48656c6c6f20776f726c642e0a0001"},
+		{BytesHexdump, "00000000: 4865 6c6c 6f20 776f 726c 642e 0a00 01    Hello world....\n"},
+	}
+	for _, test := range tests {
+		if s := formatBytes(p, test.format); s != test.expected {
+			t.Error(fmt.Sprintf("%s: %q != %q", test.format, s, test.expected))
+		}
+	}
+	if s := formatBytes([]byte("héllo\n"), BytesAuto); s != "héllo\n" {
+		t.Error(fmt.Sprintf("auto: %q != %q", s, "héllo\n"))
+	}
+}
+
+func TestUnmarshalEmbedded(t *testing.T) {
+	_, fDesc, packageName, messageName, err := test.GenerateFull()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f1 := "one"
+	id := int32(123)
+	bar, err := proto.Marshal(&test.Bar{Id: &id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	embedded, err := proto.Marshal(&test.Foo{F1: &f1, F11: bar})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 0x0b starts a group, so this cannot be decoded as a bar
+	invalid, err := proto.Marshal(&test.Foo{F1: &f1, F11: []byte{11, 11}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := Options{Embedded: map[string]string{"test.foo.f11": "test.bar"}}
+	PT1, err := UnmarshalOptions(fDesc, packageName, messageName, [][]byte{embedded, invalid}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	PT2 := &pfuse.ProtoTree{Dir: pfuse.Dir{Nodes: []pfuse.TreeNode{pfuse.TreeNode{Name: "Message_1", FieldNumber: 0, Type: google_protobuf.FieldDescriptorProto_TYPE_MESSAGE,
+		Node: &pfuse.Dir{Nodes: []pfuse.TreeNode{pfuse.TreeNode{Name: "f1", FieldNumber: 1, Type: google_protobuf.FieldDescriptorProto_TYPE_STRING, Node: &pfuse.File{Contents: "one"}},
+			pfuse.TreeNode{Name: "f11", FieldNumber: 11, Type: google_protobuf.FieldDescriptorProto_TYPE_BYTES,
+				Node: &pfuse.Dir{Nodes: []pfuse.TreeNode{pfuse.TreeNode{Name: "id", FieldNumber: 1, Type: google_protobuf.FieldDescriptorProto_TYPE_INT32, Node: &pfuse.File{Contents: "123"}}}}}}}},
+		pfuse.TreeNode{Name: "Message_2", FieldNumber: 0, Type: google_protobuf.FieldDescriptorProto_TYPE_MESSAGE,
+			Node: &pfuse.Dir{Nodes: []pfuse.TreeNode{pfuse.TreeNode{Name: "f1", FieldNumber: 1, Type: google_protobuf.FieldDescriptorProto_TYPE_STRING, Node: &pfuse.File{Contents: "one"}},
+				pfuse.TreeNode{Name: "f11", FieldNumber: 11, Type: google_protobuf.FieldDescriptorProto_TYPE_BYTES, Node: &pfuse.File{Contents: "0b0b"}}}}}}}}
+
+	compareProtoTree(PT1, PT2, t)
+}
+
+func TestUnmarshalTruncated(t *testing.T) {
+	_, fDesc, packageName, messageName, err := test.GenerateFull()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// f1 claims a length of 4GB
+	huge := []byte{0x0a, 0xff, 0xff, 0xff, 0xff, 0x0f}
+	if _, err := Unmarshal(fDesc, packageName, messageName, [][]byte{huge}); err == nil {
+		t.Error("Expected an error for a length running past the end of the message")
+	}
+
+	// an f16 holding a group, which cannot be decoded as a baz
+	nested := []byte{0x82, 0x01, 0x02, 11, 11}
+	f1 := "one"
+	tests := []struct {
+		p        []byte
+		expected string
+	}{
+		{huge, "0affffffff0f"},
+		{nested, "8201020b0b"},
+	}
+	opts := Options{Embedded: map[string]string{"test.foo.f11": "test.foo"}}
+	for _, test2 := range tests {
+		buf, err := proto.Marshal(&test.Foo{F1: &f1, F11: test2.p})
+		if err != nil {
+			t.Fatal(err)
+		}
+		PT, err := UnmarshalOptions(fDesc, packageName, messageName, [][]byte{buf}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, ok := PT.Dir.Nodes[0].Node.(*pfuse.Dir).Nodes[1].Node.(*pfuse.File)
+		if !ok || file.Contents != test2.expected {
+			t.Error(fmt.Sprintf("Expected f11 to fall back to %s, got %#v", test2.expected, PT.Dir.Nodes[0].Node.(*pfuse.Dir).Nodes[1].Node))
+		}
+	}
+}
+
+// Builds a FileDescriptorSet with google.protobuf.Any and a message carrying one.
+func anyFileDescriptorSet() *google_protobuf.FileDescriptorSet {
+	optional := google_protobuf.FieldDescriptorProto_LABEL_OPTIONAL.Enum()
+	field := func(name string, number int32, typ google_protobuf.FieldDescriptorProto_Type, typeName string) *google_protobuf.FieldDescriptorProto {
+		f := &google_protobuf.FieldDescriptorProto{Name: proto.String(name), Number: proto.Int32(number), Label: optional, Type: typ.Enum()}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	events := field("events", 1, google_protobuf.FieldDescriptorProto_TYPE_MESSAGE, ".google.protobuf.Any")
+	events.Label = google_protobuf.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	return &google_protobuf.FileDescriptorSet{File: []*google_protobuf.FileDescriptorProto{
+		&google_protobuf.FileDescriptorProto{Name: proto.String("google/protobuf/any.proto"), Package: proto.String("google.protobuf"),
+			MessageType: []*google_protobuf.DescriptorProto{&google_protobuf.DescriptorProto{Name: proto.String("Any"), Field: []*google_protobuf.FieldDescriptorProto{
+				field("type_url", 1, google_protobuf.FieldDescriptorProto_TYPE_STRING, ""),
+				field("value", 2, google_protobuf.FieldDescriptorProto_TYPE_BYTES, "")}}}},
+		&google_protobuf.FileDescriptorProto{Name: proto.String("env.proto"), Package: proto.String("env"),
+			MessageType: []*google_protobuf.DescriptorProto{
+				&google_protobuf.DescriptorProto{Name: proto.String("Envelope"), Field: []*google_protobuf.FieldDescriptorProto{
+					field("payload", 1, google_protobuf.FieldDescriptorProto_TYPE_MESSAGE, ".google.protobuf.Any")}},
+				&google_protobuf.DescriptorProto{Name: proto.String("Event"), Field: []*google_protobuf.FieldDescriptorProto{
+					field("name", 1, google_protobuf.FieldDescriptorProto_TYPE_STRING, "")}},
+				&google_protobuf.DescriptorProto{Name: proto.String("Batch"), Field: []*google_protobuf.FieldDescriptorProto{
+					events}}}},
+	}}
+}
+
+// Appends a length delimited field to buf.
+func appendBytes(buf []byte, number int, p []byte) []byte {
+	buf = append(buf, proto.EncodeVarint(uint64(number<<3|2))...)
+	buf = append(buf, proto.EncodeVarint(uint64(len(p)))...)
+	return append(buf, p...)
+}
+
+func TestMatchesSchema(t *testing.T) {
+	buf, fDesc, packageName, messageName, err := test.GenerateFull()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		p        []byte
+		expected bool
+	}{
+		{buf, true},
+		{[]byte{}, true},
+		// f1 sent as a varint
+		{[]byte{0x08, 0x01}, false},
+		// field 99 is not declared
+		{[]byte{0x98, 0x06, 0x01}, false},
+		// f121, an extension of foo
+		{[]byte{0xc8, 0x07, 0x7b}, true},
+		// f12 holding a bar whose id is sent as a fixed32
+		{[]byte{0x62, 0x05, 0x0d, 0x7b, 0, 0, 0}, false},
+		{[]byte{0x0a, 0x05, 'o'}, false},
+	}
+	for _, test2 := range tests {
+		if m := MatchesSchema(fDesc, packageName, messageName, test2.p); m != test2.expected {
+			t.Error(fmt.Sprintf("MatchesSchema(%x) = %v, expected %v", test2.p, m, test2.expected))
+		}
+	}
+	if MatchesSchema(fDesc, packageName, "missing", buf) {
+		t.Error("Expected no match for a message missing from the schema")
+	}
+}
+
+func TestUnmarshalAny(t *testing.T) {
+	event := appendBytes(nil, 1, []byte("created"))
+	any := appendBytes(appendBytes(nil, 1, []byte("type.googleapis.com/env.Event")), 2, event)
+	envelope := appendBytes(nil, 1, any)
+
+	PT1, err := Unmarshal(anyFileDescriptorSet(), "env", "Envelope", [][]byte{envelope})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	PT2 := &pfuse.ProtoTree{Dir: pfuse.Dir{Nodes: []pfuse.TreeNode{pfuse.TreeNode{Name: "Message_1", FieldNumber: 0, Type: google_protobuf.FieldDescriptorProto_TYPE_MESSAGE,
+		Node: &pfuse.Dir{Nodes: []pfuse.TreeNode{pfuse.TreeNode{Name: "payload", FieldNumber: 1, Type: google_protobuf.FieldDescriptorProto_TYPE_MESSAGE,
+			Node: &pfuse.Dir{Nodes: []pfuse.TreeNode{
+				pfuse.TreeNode{Name: "@type", FieldNumber: pfuse.TypeURLFieldNumber, Type: google_protobuf.FieldDescriptorProto_TYPE_STRING, Node: &pfuse.File{Contents: "type.googleapis.com/env.Event"}},
+				pfuse.TreeNode{Name: "name", FieldNumber: 1, Type: google_protobuf.FieldDescriptorProto_TYPE_STRING, Node: &pfuse.File{Contents: "created"}}}}}}}}}}}
+
+	compareProtoTree(PT1, PT2, t)
+}
+
+func TestUnmarshalNestedAny(t *testing.T) {
+	pack := func(typeName string, p []byte) []byte {
+		return appendBytes(appendBytes(nil, 1, []byte("type.googleapis.com/"+typeName)), 2, p)
+	}
+	// a batch whose events, like the @type of the batch, are field 1
+	var batch []byte
+	for _, name := range []string{"created", "deleted"} {
+		batch = appendBytes(batch, 1, pack("env.Event", appendBytes(nil, 1, []byte(name))))
+	}
+	envelope := appendBytes(nil, 1, pack("env.Batch", batch))
+
+	PT, err := Unmarshal(anyFileDescriptorSet(), "env", "Envelope", [][]byte{envelope})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := PT.Dir.Nodes[0].Node.(*pfuse.Dir).Nodes[0].Node.(*pfuse.Dir)
+	if len(payload.Nodes) != 3 || payload.Nodes[0].FieldNumber != pfuse.TypeURLFieldNumber {
+		t.Fatal(fmt.Sprintf("Unexpected nodes in payload: %v", payload.Nodes))
+	}
+	for i, tn := range payload.Nodes[1:] {
+		event, ok := tn.Node.(*pfuse.Dir)
+		if tn.FieldNumber != 1 || !ok || len(event.Nodes) != 2 || event.Nodes[0].FieldNumber != pfuse.TypeURLFieldNumber {
+			t.Error(fmt.Sprintf("Unexpected event %d: %v", i, tn))
+		}
+	}
+
+	js, err := payload.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"@type":"type.googleapis.com/env.Batch","events":[{"@type":"type.googleapis.com/env.Event","name":"created"},{"@type":"type.googleapis.com/env.Event","name":"deleted"}]}`
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, js); err != nil {
+		t.Fatal(err)
+	}
+	if compact.String() != expected {
+		t.Error(fmt.Sprintf("JSON doesn't match: %s != %s", compact.String(), expected))
+	}
+	text := "[type.googleapis.com/env.Batch] {\n" +
+		"  events {\n    [type.googleapis.com/env.Event] {\n      name: \"created\"\n    }\n  }\n" +
+		"  events {\n    [type.googleapis.com/env.Event] {\n      name: \"deleted\"\n    }\n  }\n" +
+		"}\n"
+	if got := string(payload.Text()); got != text {
+		t.Error(fmt.Sprintf("Expected %q, got %q", text, got))
+	}
+}
+
+func TestWellKnownTypes(t *testing.T) {
+	varint := func(number int, x uint64) []byte {
+		return append(proto.EncodeVarint(uint64(number<<3)), proto.EncodeVarint(x)...)
+	}
+	value := appendBytes(nil, 3, []byte("x"))
+	list := appendBytes(appendBytes(nil, 1, value), 1, varint(4, 1))
+	entry := appendBytes(appendBytes(nil, 1, []byte("a")), 2, appendBytes(nil, 6, list))
+
+	tests := []struct {
+		typeName string
+		p        []byte
+		expected string
+	}{
+		{".google.protobuf.Timestamp", append(varint(1, 1420070400), varint(2, 500000000)...), "2015-01-01T00:00:00.500Z"},
+		{".google.protobuf.Timestamp", nil, "1970-01-01T00:00:00Z"},
+		{".google.protobuf.Duration", append(varint(1, 1), varint(2, 500000000)...), "1.500s"},
+		{".google.protobuf.Duration", append(varint(1, uint64(1<<64-3)), varint(2, uint64(1<<64-1000))...), "-3.000001s"},
+		{".google.protobuf.Int64Value", varint(1, uint64(1<<64-5)), "-5"},
+		{".google.protobuf.BoolValue", varint(1, 1), "true"},
+		{".google.protobuf.StringValue", appendBytes(nil, 1, []byte("hello")), "hello"},
+		{".google.protobuf.BytesValue", appendBytes(nil, 1, []byte("hello")), "aGVsbG8="},
+		{".google.protobuf.Struct", appendBytes(nil, 1, entry), `{"a":["x",true]}`},
+		{".google.protobuf.FieldMask", appendBytes(appendBytes(nil, 1, []byte("user.display_name")), 1, []byte("id")), "user.displayName,id"},
+		{".google.protobuf.Empty", nil, "{}"},
+	}
+	for _, test := range tests {
+		s, err := wellKnownTypes[test.typeName](test.p)
+		if err != nil {
+			t.Error(err)
+		} else if s != test.expected {
+			t.Error(fmt.Sprintf("%s: %s != %s", test.typeName, s, test.expected))
+		}
+	}
+
+	// numbers sent with the wrong wire type or length
+	malformed := []struct {
+		typeName string
+		p        []byte
+	}{
+		{".google.protobuf.DoubleValue", appendBytes(nil, 1, []byte{1, 2, 3})},
+		{".google.protobuf.DoubleValue", varint(1, 1)},
+		{".google.protobuf.FloatValue", appendBytes(nil, 1, []byte{1, 2, 3, 4, 5})},
+		{".google.protobuf.Value", appendBytes(nil, 2, []byte{1})},
+		{".google.protobuf.Struct", appendBytes(nil, 1, appendBytes(appendBytes(nil, 1, []byte("a")), 2, varint(2, 1)))},
+	}
+	for _, test := range malformed {
+		if s, err := wellKnownTypes[test.typeName](test.p); err == nil {
+			t.Error(fmt.Sprintf("%s: expected an error for %x, got %s", test.typeName, test.p, s))
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	_, fDesc, packageName, messageName, err := test.GenerateFull()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f1 := "one"
+	f3 := int64(3)
+	buf, err := proto.Marshal(&test.Foo{F1: &f1, F2: []int32{1, 2}, F3: &f3, F11: []byte{11, 11}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	PT, err := Unmarshal(fDesc, packageName, messageName, [][]byte{buf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := PT.Dir.Nodes[0].Node.(*pfuse.Dir)
+
+	j, err := dir.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "{\n  \"f1\": \"one\",\n  \"f2\": [\n    1,\n    2\n  ],\n  \"f3\": \"3\",\n  \"f11\": \"Cws=\"\n}\n"
+	if string(j) != expected {
+		t.Error(fmt.Sprintf("JSON doesn't match: %s != %s", j, expected))
+	}
+
+	expected = "f1: \"one\"\nf2: 1\nf2: 2\nf3: 3\nf11: \"\\013\\013\"\n"
+	if text := string(dir.Text()); text != expected {
+		t.Error(fmt.Sprintf("Text doesn't match: %s != %s", text, expected))
+	}
+
+	if string(dir.Raw) != string(buf) {
+		t.Error("Raw bytes don't match the marshaled message")
+	}
+}
+
+func TestUnmarshalConcurrent(t *testing.T) {
+	buf, fDesc, packageName, messageName, err := test.GenerateFull()
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := appendBytes(nil, 1, []byte("created"))
+	envelope := appendBytes(nil, 1, appendBytes(appendBytes(nil, 1, []byte("type.googleapis.com/env.Event")), 2, event))
+
+	// two sources with their own schemas and options, decoded at the same
+	// time as they would be by a mount of both
+	sources := []struct {
+		decode   func() (*pfuse.ProtoTree, error)
+		expected string
+	}{
+		{decode: func() (*pfuse.ProtoTree, error) {
+			return UnmarshalOptions(fDesc, packageName, messageName, [][]byte{buf}, Options{Bytes: BytesBase64, Naming: Naming{Subdirs: true}})
+		}},
+		{decode: func() (*pfuse.ProtoTree, error) {
+			return Unmarshal(anyFileDescriptorSet(), "env", "Envelope", [][]byte{envelope})
+		}},
+	}
+	for i := range sources {
+		PT, err := sources[i].decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources[i].expected = string(PT.Dir.Nodes[0].Node.(*pfuse.Dir).Text())
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		source := sources[i%len(sources)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				PT, err := source.decode()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if text := string(PT.Dir.Nodes[0].Node.(*pfuse.Dir).Text()); text != source.expected {
+					t.Error(fmt.Sprintf("Decoded %q, expected %q", text, source.expected))
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestExportProto3(t *testing.T) {
+	optional := google_protobuf.FieldDescriptorProto_LABEL_OPTIONAL.Enum()
+	field := func(name string, number int32, typ google_protobuf.FieldDescriptorProto_Type, typeName string) *google_protobuf.FieldDescriptorProto {
+		f := &google_protobuf.FieldDescriptorProto{Name: proto.String(name), Number: proto.Int32(number), Label: optional, Type: typ.Enum()}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	counts := field("counts", 1, google_protobuf.FieldDescriptorProto_TYPE_MESSAGE, ".m.Metrics.CountsEntry")
+	counts.Label = google_protobuf.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	fDesc := &google_protobuf.FileDescriptorSet{File: []*google_protobuf.FileDescriptorProto{
+		&google_protobuf.FileDescriptorProto{Name: proto.String("m.proto"), Package: proto.String("m"),
+			MessageType: []*google_protobuf.DescriptorProto{
+				&google_protobuf.DescriptorProto{Name: proto.String("Metrics"), Field: []*google_protobuf.FieldDescriptorProto{
+					counts,
+					field("payload", 2, google_protobuf.FieldDescriptorProto_TYPE_BYTES, ""),
+					field("ratio", 3, google_protobuf.FieldDescriptorProto_TYPE_DOUBLE, ""),
+					field("scale", 4, google_protobuf.FieldDescriptorProto_TYPE_FLOAT, "")},
+					NestedType: []*google_protobuf.DescriptorProto{&google_protobuf.DescriptorProto{Name: proto.String("CountsEntry"),
+						Field: []*google_protobuf.FieldDescriptorProto{
+							field("key", 1, google_protobuf.FieldDescriptorProto_TYPE_STRING, ""),
+							field("value", 2, google_protobuf.FieldDescriptorProto_TYPE_DOUBLE, "")},
+						Options: &google_protobuf.MessageOptions{MapEntry: proto.Bool(true)}}}},
+				&google_protobuf.DescriptorProto{Name: proto.String("Point"), Field: []*google_protobuf.FieldDescriptorProto{
+					field("x", 1, google_protobuf.FieldDescriptorProto_TYPE_FLOAT, "")}}}},
+	}}
+
+	double := func(number int, x float64) []byte {
+		buf := append(proto.EncodeVarint(uint64(number<<3|1)), make([]byte, 8)...)
+		binary.LittleEndian.PutUint64(buf[len(buf)-8:], math.Float64bits(x))
+		return buf
+	}
+	float := func(number int, x float32) []byte {
+		buf := append(proto.EncodeVarint(uint64(number<<3|5)), make([]byte, 4)...)
+		binary.LittleEndian.PutUint32(buf[len(buf)-4:], math.Float32bits(x))
+		return buf
+	}
+	point := float(1, 1.23e-05)
+	var metrics []byte
+	metrics = appendBytes(metrics, 1, append(appendBytes(nil, 1, []byte("a")), double(2, 1.234567891234)...))
+	metrics = appendBytes(metrics, 1, append(appendBytes(nil, 1, []byte("b")), double(2, math.Inf(1))...))
+	metrics = appendBytes(metrics, 2, point)
+	metrics = append(metrics, double(3, math.Inf(-1))...)
+	metrics = append(metrics, float(4, float32(math.NaN()))...)
+
+	opts := Options{Embedded: map[string]string{"m.Metrics.payload": "m.Point"}}
+	PT, err := UnmarshalOptions(fDesc, "m", "Metrics", [][]byte{metrics}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := PT.Dir.Nodes[0].Node.(*pfuse.Dir)
+	if _, ok := dir.Nodes[2].Node.(*pfuse.Dir); !ok {
+		t.Fatal(fmt.Sprintf("Expected payload to be shown as a point, got %#v", dir.Nodes[2].Node))
+	}
+
+	js, err := dir.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, js); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"counts":{"a":1.234567891234,"b":"Infinity"},"payload":"DRlcTjc=","ratio":"-Infinity","scale":"NaN"}`
+	if compact.String() != expected {
+		t.Error(fmt.Sprintf("JSON doesn't match: %s != %s", compact.String(), expected))
+	}
+
+	expected = "counts {\n  key: \"a\"\n  value: 1.234567891234\n}\ncounts {\n  key: \"b\"\n  value: inf\n}\n" +
+		"payload: \"\\015\\031\\\\N7\"\nratio: -inf\nscale: nan\n"
+	if text := string(dir.Text()); text != expected {
+		t.Error(fmt.Sprintf("Text doesn't match: %q != %q", text, expected))
+	}
+}
+
+func TestNaming(t *testing.T) {
+	_, fDesc, packageName, messageName, err := test.GenerateFull()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f1 := "one"
+	F2 := make([]int32, 12)
+	buf, err := proto.Marshal(&test.Foo{F1: &f1, F2: F2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := func(dir *pfuse.Dir) []string {
+		var names []string
+		for _, tn := range dir.Nodes {
+			names = append(names, tn.Name)
+		}
+		return names
+	}
+
+	PT, err := UnmarshalOptions(fDesc, packageName, messageName, [][]byte{buf}, Options{Naming: Naming{Pad: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := PT.Dir.Nodes[0].Node.(*pfuse.Dir)
+	if got := names(dir); got[1] != "f2_01" || got[12] != "f2_12" {
+		t.Error(fmt.Sprintf("Padded names don't match: %v", got))
+	}
+
+	PT, err = UnmarshalOptions(fDesc, packageName, messageName, [][]byte{buf}, Options{Naming: Naming{Subdirs: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir = PT.Dir.Nodes[0].Node.(*pfuse.Dir)
+	if got := names(dir); !reflect.DeepEqual(got, []string{"f1", "f2"}) {
+		t.Fatal(fmt.Sprintf("Subdirectory names don't match: %v", got))
+	}
+	list := dir.Nodes[1].Node.(*pfuse.Dir)
+	if got := names(list); len(got) != 12 || got[0] != "0" || got[11] != "11" {
+		t.Error(fmt.Sprintf("Element names don't match: %v", got))
+	}
+	if text := string(dir.Text()); text != "f1: \"one\"\n"+strings.Repeat("f2: 0\n", 12) {
+		t.Error(fmt.Sprintf("Text of subdirectory layout doesn't match: %s", text))
+	}
+
+	PT, err = UnmarshalOptions(fDesc, packageName, messageName, [][]byte{buf}, Options{Naming: Naming{Subdirs: true, Extensions: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir = PT.Dir.Nodes[0].Node.(*pfuse.Dir)
+	if got := names(dir); !reflect.DeepEqual(got, []string{"f1.txt", "f2"}) {
+		t.Fatal(fmt.Sprintf("Names with extensions don't match: %v", got))
+	}
+	if got := names(dir.Nodes[1].Node.(*pfuse.Dir)); got[0] != "0.txt" {
+		t.Error(fmt.Sprintf("Element names with extensions don't match: %v", got))
+	}
+}
+
+func TestFieldMeta(t *testing.T) {
+	_, fDesc, packageName, messageName, err := test.GenerateFull()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f1 := "one"
+	buf, err := proto.Marshal(&test.Foo{F1: &f1, F2: []int32{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	PT, err := Unmarshal(fDesc, packageName, messageName, [][]byte{buf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := PT.Dir.Nodes[0].Node.(*pfuse.Dir)
+	if dir.Meta != nil {
+		t.Error("Message entry has field metadata")
+	}
+	meta := dir.Nodes[0].Node.(*pfuse.File).Meta
+	if meta == nil {
+		t.Fatal("Field f1 has no metadata")
+	}
+	if meta.FullName != "test.foo.f1" || meta.Descriptor.GetNumber() != 1 {
+		t.Error(fmt.Sprintf("Metadata of f1 doesn't match: %s %d", meta.FullName, meta.Descriptor.GetNumber()))
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	type option struct {
+		field string
+		name  string
+		value interface{}
+	}
+	tests := []struct {
+		options       []option
+		showSensitive bool
+		field         string
+		expected      string
+	}{
+		{nil, false, "f3", "3"},
+		{[]option{{"f1", "sensitive", true}}, false, "f1", pfuse.Redacted},
+		{[]option{{"f1", "sensitive", true}}, true, "f1", "one"},
+		{[]option{{"f1", "sensitive", false}}, false, "f1", "one"},
+		{[]option{{"f3", "unit", "ms"}}, false, "f3", "3 ms"},
+		{[]option{{"f1", "unit", "ms"}}, false, "f1", "one"},
+		{[]option{{"f11", "unit", "B"}}, false, "f11", "0b0b"},
+		{[]option{{"f4", "format", "hex"}}, false, "f4", "0x4"},
+		{[]option{{"f10", "format", "%.2f"}}, false, "f10", "10.00"},
+		{[]option{{"f11", "format", "base64"}}, false, "f11", "Cws="},
+		{[]option{{"f13", "format", "bin"}, {"f13", "unit", "flags"}}, false, "f13", "0b1101 flags"},
+		{[]option{{"f3", "unit", "ms"}}, false, "f4", "4"},
+	}
+	for _, test2 := range tests {
+		buf, fDesc, packageName, messageName, err := test.GenerateFull()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, o := range test2.options {
+			test.Annotate(fDesc, o.field, o.name, o.value)
+		}
+		opts := Options{Annotations: Annotations{Sensitive: "sensitive", Unit: "unit", Format: "format"}, ShowSensitive: test2.showSensitive}
+		PT, err := UnmarshalOptions(fDesc, packageName, messageName, [][]byte{buf}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var contents string
+		for _, tn := range PT.Dir.Nodes[0].Node.(*pfuse.Dir).Nodes {
+			if tn.Name == test2.field {
+				contents = tn.Node.(*pfuse.File).Contents
+			}
+		}
+		if contents != test2.expected {
+			t.Error(fmt.Sprintf("%v: %s is %q, expected %q", test2.options, test2.field, contents, test2.expected))
+		}
+	}
+}
+
+func TestAnnotatedExport(t *testing.T) {
+	buf, fDesc, packageName, messageName, err := test.GenerateFull()
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Annotate(fDesc, "f4", "unit", "ms")
+	test.Annotate(fDesc, "f13", "format", "hex")
+	opts := Options{Annotations: Annotations{Unit: "unit", Format: "format"}}
+	PT, err := UnmarshalOptions(fDesc, packageName, messageName, [][]byte{buf}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := PT.Dir.Nodes[0].Node.(*pfuse.Dir)
+
+	// the files show the annotations, the exports the numbers
+	js, err := dir.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(js, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["f4"] != float64(4) || m["f13"] != float64(13) {
+		t.Error(fmt.Sprintf("Expected numbers in the JSON export, got f4 %v and f13 %v", m["f4"], m["f13"]))
+	}
+	text := string(dir.Text())
+	if !strings.Contains(text, "f4: 4\n") || !strings.Contains(text, "f13: 13\n") {
+		t.Error(fmt.Sprintf("Expected numbers in the text export, got %s", text))
+	}
+}
+
+func TestNamingCollisions(t *testing.T) {
+	repeated := google_protobuf.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	optional := google_protobuf.FieldDescriptorProto_LABEL_OPTIONAL.Enum()
+	str := google_protobuf.FieldDescriptorProto_TYPE_STRING.Enum()
+	fDesc := &google_protobuf.FileDescriptorSet{File: []*google_protobuf.FileDescriptorProto{
+		&google_protobuf.FileDescriptorProto{Name: proto.String("n.proto"), Package: proto.String("n"),
+			MessageType: []*google_protobuf.DescriptorProto{
+				&google_protobuf.DescriptorProto{Name: proto.String("Doc"), Field: []*google_protobuf.FieldDescriptorProto{
+					&google_protobuf.FieldDescriptorProto{Name: proto.String("tags"), Number: proto.Int32(1), Label: repeated, Type: str},
+					&google_protobuf.FieldDescriptorProto{Name: proto.String("tags_1"), Number: proto.Int32(2), Label: optional, Type: str},
+					&google_protobuf.FieldDescriptorProto{Name: proto.String("people"), Number: proto.Int32(3), Label: repeated,
+						Type: google_protobuf.FieldDescriptorProto_TYPE_MESSAGE.Enum(), TypeName: proto.String(".n.Person")}}},
+				&google_protobuf.DescriptorProto{Name: proto.String("Person"), Field: []*google_protobuf.FieldDescriptorProto{
+					&google_protobuf.FieldDescriptorProto{Name: proto.String("email"), Number: proto.Int32(1), Label: optional, Type: str}}}}},
+	}}
+
+	var doc []byte
+	doc = appendBytes(doc, 1, []byte("first"))
+	doc = appendBytes(doc, 2, []byte("real"))
+	for _, email := range []string{"alice", "alice", ""} {
+		doc = appendBytes(doc, 3, appendBytes(nil, 1, []byte(email)))
+	}
+
+	names := func(dir *pfuse.Dir) []string {
+		var names []string
+		for _, tn := range dir.Nodes {
+			names = append(names, tn.Name)
+		}
+		return names
+	}
+
+	PT, err := UnmarshalOptions(fDesc, "n", "Doc", [][]byte{doc}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := PT.Dir.Nodes[0].Node.(*pfuse.Dir)
+	if got := names(dir); !reflect.DeepEqual(got, []string{"tags_01", "tags_1", "people_1", "people_2", "people_3"}) {
+		t.Error(fmt.Sprintf("Names with a colliding field don't match: %v", got))
+	}
+	if file := dir.Nodes[1].Node.(*pfuse.File); file.Contents != "real" {
+		t.Error(fmt.Sprintf("Field tags_1 was renamed instead of the element, it holds %q", file.Contents))
+	}
+
+	PT, err = UnmarshalOptions(fDesc, "n", "Doc", [][]byte{doc}, Options{Naming: Naming{Keys: map[string]string{"n.Doc.people": "email"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir = PT.Dir.Nodes[0].Node.(*pfuse.Dir)
+	people := dir.Nodes[len(dir.Nodes)-1].Node.(*pfuse.Dir)
+	if got := names(people); !reflect.DeepEqual(got, []string{"alice", "1", "2"}) {
+		t.Error(fmt.Sprintf("Names with duplicate and empty keys don't match: %v", got))
+	}
+}
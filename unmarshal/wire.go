@@ -0,0 +1,179 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package unmarshal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+)
+
+// rawField is a field read from the wire without consulting a descriptor.
+type rawField struct {
+	number   int32
+	wireType int8
+	// value of varint fields
+	varint uint64
+	// value of fixed32, fixed64 and length delimited fields
+	bytes []byte
+}
+
+// Splits a marshaled message into its fields, for the small well-known
+// messages that are simpler to read directly than through their descriptors.
+func readFields(p []byte) ([]rawField, error) {
+	var fields []rawField
+	buf := bytes.NewBuffer(p)
+	for buf.Len() != 0 {
+		wireType, fieldNumber, err := decodeKey(buf)
+		if err != nil {
+			return nil, err
+		}
+		f := rawField{number: fieldNumber, wireType: wireType}
+		switch wireType {
+		case 0:
+			x, n := binary.Uvarint(buf.Bytes())
+			if n <= 0 {
+				return nil, fmt.Errorf("decodeVarint n = %d", n)
+			}
+			buf.Next(n)
+			f.varint = x
+		case 1:
+			if buf.Len() < 8 {
+				return nil, fmt.Errorf("Fixed64: buffer too short")
+			}
+			f.bytes = buf.Next(8)
+		case 2:
+			l, n := binary.Uvarint(buf.Bytes())
+			if n <= 0 {
+				return nil, fmt.Errorf("decodeVarint n = %d", n)
+			}
+			buf.Next(n)
+			if uint64(buf.Len()) < l {
+				return nil, fmt.Errorf("Length delimited field %d: buffer too short", fieldNumber)
+			}
+			f.bytes = buf.Next(int(l))
+		case 5:
+			if buf.Len() < 4 {
+				return nil, fmt.Errorf("Fixed32: buffer too short")
+			}
+			f.bytes = buf.Next(4)
+		default:
+			return nil, fmt.Errorf("Invalid wire type: %d", wireType)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// Gets the value of a double field, failing if f was not sent as one.
+func (f rawField) double() (float64, error) {
+	if f.wireType != 1 || len(f.bytes) != 8 {
+		return 0, fmt.Errorf("Field %d is not a double", f.number)
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(f.bytes)), nil
+}
+
+// Gets the value of a float field, failing if f was not sent as one.
+func (f rawField) float() (float32, error) {
+	if f.wireType != 5 || len(f.bytes) != 4 {
+		return 0, fmt.Errorf("Field %d is not a float", f.number)
+	}
+	return math.Float32frombits(binary.LittleEndian.Uint32(f.bytes)), nil
+}
+
+// IsWireFormat reports whether p splits cleanly into fields of the wire
+// format, as a guess at whether p is a marshaled message.
+func IsWireFormat(p []byte) bool {
+	fields, err := readFields(p)
+	if err != nil {
+		return false
+	}
+	for _, f := range fields {
+		if f.number <= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// The wire type each field type is marshaled with.
+var wireTypes = map[google_protobuf.FieldDescriptorProto_Type]int8{
+	google_protobuf.FieldDescriptorProto_TYPE_INT32:    0,
+	google_protobuf.FieldDescriptorProto_TYPE_INT64:    0,
+	google_protobuf.FieldDescriptorProto_TYPE_UINT32:   0,
+	google_protobuf.FieldDescriptorProto_TYPE_UINT64:   0,
+	google_protobuf.FieldDescriptorProto_TYPE_SINT32:   0,
+	google_protobuf.FieldDescriptorProto_TYPE_SINT64:   0,
+	google_protobuf.FieldDescriptorProto_TYPE_BOOL:     0,
+	google_protobuf.FieldDescriptorProto_TYPE_ENUM:     0,
+	google_protobuf.FieldDescriptorProto_TYPE_FIXED64:  1,
+	google_protobuf.FieldDescriptorProto_TYPE_SFIXED64: 1,
+	google_protobuf.FieldDescriptorProto_TYPE_DOUBLE:   1,
+	google_protobuf.FieldDescriptorProto_TYPE_STRING:   2,
+	google_protobuf.FieldDescriptorProto_TYPE_BYTES:    2,
+	google_protobuf.FieldDescriptorProto_TYPE_MESSAGE:  2,
+	google_protobuf.FieldDescriptorProto_TYPE_GROUP:    3,
+	google_protobuf.FieldDescriptorProto_TYPE_FIXED32:  5,
+	google_protobuf.FieldDescriptorProto_TYPE_SFIXED32: 5,
+	google_protobuf.FieldDescriptorProto_TYPE_FLOAT:    5,
+}
+
+// MatchesSchema reports whether p is a marshaled message of type
+// messageName in package packageName: every field must be declared by the
+// message or one of its extensions and have the wire type of its type, and
+// the fields of nested messages must match their own types. It is a
+// stricter guess than IsWireFormat.
+func MatchesSchema(fDesc *google_protobuf.FileDescriptorSet, packageName string, messageName string, p []byte) bool {
+	msg := fDesc.GetMessage(packageName, messageName)
+	if msg == nil {
+		return false
+	}
+	return matchesMessage(fDesc, msg, packageName, p)
+}
+
+func matchesMessage(fDesc *google_protobuf.FileDescriptorSet, msg *google_protobuf.DescriptorProto, packageName string, p []byte) bool {
+	fields, err := readFields(p)
+	if err != nil {
+		return false
+	}
+	for _, f := range fields {
+		var field *google_protobuf.FieldDescriptorProto
+		if isExtension(msg, f.number) {
+			_, field = fDesc.FindExtensionByFieldNumber(packageName, msg.GetName(), f.number)
+		} else {
+			field, _ = getField(msg, f.number)
+		}
+		if field == nil {
+			return false
+		}
+		wireType := wireTypes[field.GetType()]
+		packed := f.wireType == 2 && wireType != 2 && field.GetLabel() == google_protobuf.FieldDescriptorProto_LABEL_REPEATED
+		if f.wireType != wireType && !packed {
+			return false
+		}
+		if field.GetType() != google_protobuf.FieldDescriptorProto_TYPE_MESSAGE {
+			continue
+		}
+		// messages missing from the descriptors, such as well-known types
+		// that were not compiled in, are not looked into
+		if nested, nestedPackage, err := findDescriptorProto(fDesc, field.GetTypeName()); err == nil && !matchesMessage(fDesc, nested, nestedPackage, f.bytes) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,292 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package unmarshal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elrichgro/protofuse/fuse"
+)
+
+// Renderers for the well-known types, producing the value of the type in
+// its canonical proto3 JSON form. Strings are not quoted.
+var wellKnownTypes = map[string]func(p []byte) (string, error){
+	".google.protobuf.Timestamp":   renderTimestamp,
+	".google.protobuf.Duration":    renderDuration,
+	".google.protobuf.DoubleValue": renderDoubleValue,
+	".google.protobuf.FloatValue":  renderFloatValue,
+	".google.protobuf.Int64Value":  renderInt64Value,
+	".google.protobuf.UInt64Value": renderUInt64Value,
+	".google.protobuf.Int32Value":  renderInt32Value,
+	".google.protobuf.UInt32Value": renderUInt32Value,
+	".google.protobuf.BoolValue":   renderBoolValue,
+	".google.protobuf.StringValue": renderStringValue,
+	".google.protobuf.BytesValue":  renderBytesValue,
+	".google.protobuf.Struct":      renderJSON(decodeStruct),
+	".google.protobuf.Value":       renderJSON(decodeValue),
+	".google.protobuf.ListValue":   renderJSON(decodeListValue),
+	".google.protobuf.FieldMask":   renderFieldMask,
+	".google.protobuf.Empty":       renderEmpty,
+}
+
+// Returns the varint and length delimited values of field 1 and 2 of p, the
+// only fields used by the well-known types rendered here.
+func readValue(p []byte) (rawField, rawField, error) {
+	var f1, f2 rawField
+	fields, err := readFields(p)
+	if err != nil {
+		return f1, f2, err
+	}
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			f1 = f
+		case 2:
+			f2 = f
+		}
+	}
+	return f1, f2, nil
+}
+
+// Formats nanos with 0, 3, 6 or 9 fractional digits, as the JSON mapping does.
+func formatNanos(nanos int64) string {
+	switch {
+	case nanos == 0:
+		return ""
+	case nanos%1000000 == 0:
+		return fmt.Sprintf(".%03d", nanos/1000000)
+	case nanos%1000 == 0:
+		return fmt.Sprintf(".%06d", nanos/1000)
+	}
+	return fmt.Sprintf(".%09d", nanos)
+}
+
+func renderTimestamp(p []byte) (string, error) {
+	seconds, nanos, err := readValue(p)
+	if err != nil {
+		return "", err
+	}
+	n := int64(int32(nanos.varint))
+	if n < 0 || n > 999999999 {
+		return "", fmt.Errorf("Timestamp: invalid nanos %d", n)
+	}
+	t := time.Unix(int64(seconds.varint), 0).UTC()
+	return t.Format("2006-01-02T15:04:05") + formatNanos(n) + "Z", nil
+}
+
+func renderDuration(p []byte) (string, error) {
+	seconds, nanos, err := readValue(p)
+	if err != nil {
+		return "", err
+	}
+	s := int64(seconds.varint)
+	n := int64(int32(nanos.varint))
+	sign := ""
+	if s < 0 || n < 0 {
+		sign = "-"
+		if s < 0 {
+			s = -s
+		}
+		if n < 0 {
+			n = -n
+		}
+	}
+	return fmt.Sprintf("%s%d%ss", sign, s, formatNanos(n)), nil
+}
+
+func renderDoubleValue(p []byte) (string, error) {
+	v, _, err := readValue(p)
+	if err != nil {
+		return "", err
+	}
+	// an absent value is 0
+	var x float64
+	if v.number != 0 {
+		if x, err = v.double(); err != nil {
+			return "", err
+		}
+	}
+	return strconv.FormatFloat(x, 'g', -1, 64), nil
+}
+
+func renderFloatValue(p []byte) (string, error) {
+	v, _, err := readValue(p)
+	if err != nil {
+		return "", err
+	}
+	var x float32
+	if v.number != 0 {
+		if x, err = v.float(); err != nil {
+			return "", err
+		}
+	}
+	return strconv.FormatFloat(float64(x), 'g', -1, 32), nil
+}
+
+func renderInt64Value(p []byte) (string, error) {
+	v, _, err := readValue(p)
+	return strconv.FormatInt(int64(v.varint), 10), err
+}
+
+func renderUInt64Value(p []byte) (string, error) {
+	v, _, err := readValue(p)
+	return strconv.FormatUint(v.varint, 10), err
+}
+
+func renderInt32Value(p []byte) (string, error) {
+	v, _, err := readValue(p)
+	return strconv.FormatInt(int64(int32(v.varint)), 10), err
+}
+
+func renderUInt32Value(p []byte) (string, error) {
+	v, _, err := readValue(p)
+	return strconv.FormatUint(uint64(uint32(v.varint)), 10), err
+}
+
+func renderBoolValue(p []byte) (string, error) {
+	v, _, err := readValue(p)
+	return strconv.FormatBool(v.varint != 0), err
+}
+
+func renderStringValue(p []byte) (string, error) {
+	v, _, err := readValue(p)
+	return string(v.bytes), err
+}
+
+func renderBytesValue(p []byte) (string, error) {
+	v, _, err := readValue(p)
+	return base64.StdEncoding.EncodeToString(v.bytes), err
+}
+
+func renderFieldMask(p []byte) (string, error) {
+	fields, err := readFields(p)
+	if err != nil {
+		return "", err
+	}
+	var paths []string
+	for _, f := range fields {
+		if f.number == 1 {
+			var segments []string
+			for _, s := range strings.Split(string(f.bytes), ".") {
+				segments = append(segments, pfuse.JSONName(s))
+			}
+			paths = append(paths, strings.Join(segments, "."))
+		}
+	}
+	return strings.Join(paths, ","), nil
+}
+
+func renderEmpty(p []byte) (string, error) {
+	return "{}", nil
+}
+
+// Renders the value decoded from p by decode as compact JSON.
+func renderJSON(decode func(p []byte) (interface{}, error)) func(p []byte) (string, error) {
+	return func(p []byte) (string, error) {
+		v, err := decode(p)
+		if err != nil {
+			return "", err
+		}
+		b, err := json.Marshal(v)
+		return string(b), err
+	}
+}
+
+// Decodes a google.protobuf.Struct.
+func decodeStruct(p []byte) (interface{}, error) {
+	fields, err := readFields(p)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]interface{})
+	for _, f := range fields {
+		if f.number != 1 {
+			continue
+		}
+		// map entries are messages with the key in field 1 and the value in field 2
+		key, value, err := readValue(f.bytes)
+		if err != nil {
+			return nil, err
+		}
+		m[string(key.bytes)], err = decodeValue(value.bytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Decodes a google.protobuf.Value.
+func decodeValue(p []byte) (interface{}, error) {
+	fields, err := readFields(p)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			v = nil
+		case 2:
+			var x float64
+			if x, err = f.double(); err != nil {
+				return nil, err
+			}
+			if math.IsNaN(x) || math.IsInf(x, 0) {
+				v = strconv.FormatFloat(x, 'g', -1, 64)
+			} else {
+				v = x
+			}
+		case 3:
+			v = string(f.bytes)
+		case 4:
+			v = f.varint != 0
+		case 5:
+			v, err = decodeStruct(f.bytes)
+		case 6:
+			v, err = decodeListValue(f.bytes)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// Decodes a google.protobuf.ListValue.
+func decodeListValue(p []byte) (interface{}, error) {
+	fields, err := readFields(p)
+	if err != nil {
+		return nil, err
+	}
+	l := []interface{}{}
+	for _, f := range fields {
+		if f.number != 1 {
+			continue
+		}
+		v, err := decodeValue(f.bytes)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, v)
+	}
+	return l, nil
+}
@@ -0,0 +1,134 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+// The watch package reports changes to files, using inotify on Linux and
+// polling elsewhere.
+package watch
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long the files must be left alone after a change before it is
+// reported, so that a file being written or several files being replaced
+// give a single change.
+const settle = 100 * time.Millisecond
+
+// target is a directory being watched, and the pattern the names of the
+// files of interest in it match. An empty pattern matches every file.
+type target struct {
+	dir     string
+	pattern string
+}
+
+func (t target) match(name string) bool {
+	if t.pattern == "" {
+		return true
+	}
+	ok, _ := filepath.Match(t.pattern, name)
+	return ok
+}
+
+// Watcher reports changes to a set of files.
+type Watcher struct {
+	targets []target
+	// events receives every change seen by the platform watcher
+	events  chan struct{}
+	changes chan struct{}
+	done    chan struct{}
+	close   sync.Once
+	platform
+}
+
+// New watches paths, each a file, a directory or a glob pattern. Files are
+// watched through their directory, so a file that is replaced, as editors
+// and code generators do, is still watched.
+func New(paths []string) (*Watcher, error) {
+	w := &Watcher{
+		events:  make(chan struct{}, 1),
+		changes: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	for _, path := range paths {
+		t := target{dir: filepath.Dir(path), pattern: filepath.Base(path)}
+		if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+			t = target{dir: path}
+		} else if err != nil && !strings.ContainsAny(path, "*?[") {
+			return nil, err
+		}
+		w.targets = append(w.targets, t)
+	}
+	if err := w.start(); err != nil {
+		return nil, err
+	}
+	go w.debounce()
+	return w, nil
+}
+
+// Changes receives a value after the watched files change. Changes made
+// while a value is waiting to be received are reported by that value.
+func (w *Watcher) Changes() <-chan struct{} {
+	return w.changes
+}
+
+// Close stops watching and closes the channel returned by Changes.
+func (w *Watcher) Close() error {
+	var err error
+	w.close.Do(func() {
+		close(w.done)
+		err = w.stop()
+	})
+	return err
+}
+
+// Reports that a watched file changed.
+func (w *Watcher) notify() {
+	select {
+	case w.events <- struct{}{}:
+	default:
+	}
+}
+
+// Passes events on to changes once the files have settled.
+func (w *Watcher) debounce() {
+	defer close(w.changes)
+	for {
+		select {
+		case <-w.events:
+		case <-w.done:
+			return
+		}
+		timer := time.NewTimer(settle)
+	settling:
+		for {
+			select {
+			case <-w.events:
+				timer.Reset(settle)
+			case <-timer.C:
+				break settling
+			case <-w.done:
+				timer.Stop()
+				return
+			}
+		}
+		select {
+		case w.changes <- struct{}{}:
+		default:
+		}
+	}
+}
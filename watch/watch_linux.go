@@ -0,0 +1,85 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+//go:build linux
+// +build linux
+
+package watch
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// The inotify events that change the files of a directory.
+const mask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// platform watches the directories of the targets with inotify.
+type platform struct {
+	file *os.File
+	// targets of each watch descriptor
+	watches map[int32][]target
+}
+
+func (w *Watcher) start() error {
+	// a non-blocking descriptor lets Close interrupt a pending read
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return os.NewSyscallError("inotify_init1", err)
+	}
+	w.file = os.NewFile(uintptr(fd), "inotify")
+	w.watches = make(map[int32][]target)
+	for _, t := range w.targets {
+		wd, err := syscall.InotifyAddWatch(fd, t.dir, mask)
+		if err != nil {
+			w.file.Close()
+			return &os.PathError{Op: "inotify_add_watch", Path: t.dir, Err: err}
+		}
+		w.watches[int32(wd)] = append(w.watches[int32(wd)], t)
+	}
+	go w.read()
+	return nil
+}
+
+func (w *Watcher) stop() error {
+	return w.file.Close()
+}
+
+// Reads inotify events until the watcher is closed.
+func (w *Watcher) read() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for i := 0; i+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[i]))
+			start := i + syscall.SizeofInotifyEvent
+			end := start + int(event.Len)
+			if end > n {
+				break
+			}
+			name := string(bytes.TrimRight(buf[start:end], "\x00"))
+			for _, t := range w.watches[event.Wd] {
+				if t.match(name) {
+					w.notify()
+				}
+			}
+			i = end
+		}
+	}
+}
@@ -0,0 +1,97 @@
+//  Copyright 2015 Elrich Groenewald
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package watch
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+// How often the targets are checked for changes.
+const interval = time.Second
+
+// platform polls the files of the targets for changes to their size and
+// modification time.
+type platform struct {
+	last map[string]state
+}
+
+type state struct {
+	size    int64
+	modTime time.Time
+}
+
+func (w *Watcher) start() error {
+	w.last = w.scan()
+	go w.poll()
+	return nil
+}
+
+func (w *Watcher) stop() error {
+	return nil
+}
+
+// Checks the targets every interval until the watcher is closed.
+func (w *Watcher) poll() {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.done:
+			return
+		}
+		current := w.scan()
+		if changed(w.last, current) {
+			w.notify()
+		}
+		w.last = current
+	}
+}
+
+// Gets the state of the files of the targets.
+func (w *Watcher) scan() map[string]state {
+	files := make(map[string]state)
+	for _, t := range w.targets {
+		infos, err := ioutil.ReadDir(t.dir)
+		if err != nil {
+			continue
+		}
+		for _, info := range infos {
+			if !info.Mode().IsRegular() || !t.match(info.Name()) {
+				continue
+			}
+			files[filepath.Join(t.dir, info.Name())] = state{info.Size(), info.ModTime()}
+		}
+	}
+	return files
+}
+
+// Reports whether any file was added, removed or changed.
+func changed(last, current map[string]state) bool {
+	if len(last) != len(current) {
+		return true
+	}
+	for file, s := range current {
+		if l, ok := last[file]; !ok || l != s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package watch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Waits for a change to be reported, failing after timeout.
+func expectChange(t *testing.T, w *Watcher, what string) {
+	select {
+	case <-w.Changes():
+	case <-time.After(5 * time.Second):
+		t.Fatal("No change reported after " + what)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protofuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "input.pb")
+	if err := ioutil.WriteFile(file, []byte{1}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := New([]string{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// the modification time may not change within the polling interval
+	if err := ioutil.WriteFile(file, []byte{1, 2}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectChange(t, w, "writing the file")
+
+	// replacing the file, as editors do, is still seen
+	tmp := filepath.Join(dir, ".input.pb.tmp")
+	if err := ioutil.WriteFile(tmp, []byte{1, 2, 3}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		t.Fatal(err)
+	}
+	expectChange(t, w, "replacing the file")
+
+	// other files in the directory are ignored
+	if err := ioutil.WriteFile(filepath.Join(dir, "other"), []byte{1}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-w.Changes():
+		t.Error("Change reported for an unwatched file")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	w.Close()
+	if _, ok := <-w.Changes(); ok {
+		t.Error("Changes not closed by Close")
+	}
+}
+
+func TestMissing(t *testing.T) {
+	if _, err := New([]string{"/nonexistent/input.pb"}); err == nil {
+		t.Error("Expected an error watching a missing file")
+	}
+}